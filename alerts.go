@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+// activeAlert is an alert that has fired and not resolved yet. Active alerts
+// are kept in the state file so a restart doesn't notify twice.
+type activeAlert struct {
+	Key          string    `json:"key"`
+	Rule         string    `json:"rule"`
+	Serial       string    `json:"serial,omitempty"`
+	Summary      string    `json:"summary"`
+	Since        time.Time `json:"since"`
+	LastNotified time.Time `json:"lastNotified"`
+}
+
+// alertRule looks at one poll and returns the alerts firing right now. When
+// ok is false the rule had nothing to look at, e.g. the Envoy didn't answer,
+// and its active alerts are left alone rather than resolved.
+type alertRule struct {
+	name      string
+	configKey string
+	evaluate  func(result pollResult, now time.Time) (firing []activeAlert, ok bool)
+}
+
+var alertRules = []alertRule{
+	{"zero_production", "zeroProduction", evaluateZeroProduction},
+	{"inverter_underperforming", "inverterUnderperforming", evaluateInverterUnderperforming},
+	{"jwt_expiry", "jwtExpiry", evaluateJWTExpiry},
+	{"envoy_unreachable", "envoyUnreachable", evaluateEnvoyUnreachable},
+	{"negative_consumption", "negativeConsumption", evaluateNegativeConsumption},
+}
+
+// alertsMutex serializes evaluateAlerts, Envoys are polled concurrently
+var alertsMutex sync.Mutex
+
+func isDaylight(now time.Time) bool {
+	hour := now.In(siteLocation()).Hour()
+	return hour >= config.Int("alerts.daylightStartHour", 10) && hour < config.Int("alerts.daylightEndHour", 15)
+}
+
+func evaluateZeroProduction(result pollResult, now time.Time) ([]activeAlert, bool) {
+	if result.Metrics == nil || len(result.Metrics.Production) == 0 {
+		return nil, false
+	}
+	if !isDaylight(now) {
+		return nil, true
+	}
+
+	maxWatts := result.Metrics.Production[0].WNow
+	for _, production := range result.Metrics.Production {
+		if production.WNow > maxWatts {
+			maxWatts = production.WNow
+		}
+	}
+
+	if maxWatts > config.Float("alerts.zeroProduction.thresholdWatts", 0) {
+		return nil, true
+	}
+	return []activeAlert{{
+		Key:     "zero_production",
+		Summary: fmt.Sprintf("Production is %.0fW during daylight hours", maxWatts),
+	}}, true
+}
+
+func evaluateInverterUnderperforming(result pollResult, now time.Time) ([]activeAlert, bool) {
+	if len(result.Inverters) == 0 {
+		return nil, false
+	}
+
+	watts := make([]int, 0, len(result.Inverters))
+	for _, inverter := range result.Inverters {
+		watts = append(watts, inverter.Lastreportwatts)
+	}
+	sort.Ints(watts)
+	median := float64(watts[len(watts)/2])
+	if len(watts)%2 == 0 {
+		median = float64(watts[len(watts)/2-1]+watts[len(watts)/2]) / 2
+	}
+
+	// At dawn and dusk every inverter is close to zero, percentages mean nothing
+	if median < config.Float("alerts.inverterUnderperforming.minMedianWatts", 50) {
+		return nil, true
+	}
+
+	percent := config.Float("alerts.inverterUnderperforming.percentOfMedian", 50)
+	var firing []activeAlert
+	for _, inverter := range result.Inverters {
+		if float64(inverter.Lastreportwatts) < median*percent/100 {
+			firing = append(firing, activeAlert{
+				Key:     "inverter_underperforming/" + inverter.Serialnumber,
+				Summary: fmt.Sprintf("Inverter %s produces %dW, less than %.0f%% of the array median of %.0fW", inverter.Serialnumber, inverter.Lastreportwatts, percent, median),
+			})
+		}
+	}
+	return firing, true
+}
+
+func evaluateJWTExpiry(result pollResult, now time.Time) ([]activeAlert, bool) {
+	// Firmware older than D7 doesn't use tokens at all
+	if result.Envoy.auth != envoyAuthJWT || result.Envoy.token == "" {
+		return nil, false
+	}
+	expiresAt := result.Envoy.tokenExpiry
+
+	days := config.Int("alerts.jwtExpiry.days", 14)
+	if expiresAt.Sub(now) > time.Duration(days)*24*time.Hour {
+		return nil, true
+	}
+	return []activeAlert{{
+		Key:     "jwt_expiry",
+		Summary: fmt.Sprintf("The Enphase JWT expires on %s, within %d days", expiresAt.Format(time.RFC1123), days),
+	}}, true
+}
+
+func evaluateEnvoyUnreachable(result pollResult, now time.Time) ([]activeAlert, bool) {
+	if result.Reachable {
+		return nil, true
+	}
+	lastSuccess := result.Envoy.lastSuccess
+
+	minutes := config.Int("alerts.envoyUnreachable.minutes", 15)
+	if now.Sub(lastSuccess) < time.Duration(minutes)*time.Minute {
+		return nil, true
+	}
+	return []activeAlert{{
+		Key:     "envoy_unreachable",
+		Summary: fmt.Sprintf("The Envoy hasn't answered since %s: %s", lastSuccess.Format(time.RFC1123), result.Err),
+	}}, true
+}
+
+func evaluateNegativeConsumption(result pollResult, now time.Time) ([]activeAlert, bool) {
+	if result.Metrics == nil {
+		return nil, false
+	}
+
+	threshold := config.Float("alerts.negativeConsumption.thresholdWatts", 10)
+	var firing []activeAlert
+	for _, consumption := range result.Metrics.Consumption {
+		if consumption.MeasurementType == "total-consumption" && consumption.WNow < -threshold {
+			firing = append(firing, activeAlert{
+				Key:     "negative_consumption/" + consumption.MeasurementType,
+				Summary: fmt.Sprintf("The consumption CT reads %.0fW, check its orientation", consumption.WNow),
+			})
+		}
+	}
+	return firing, true
+}
+
+// evaluateAlerts runs every enabled rule against a poll, notifies alerts that
+// just started firing and sends a resolve notification for those that stopped.
+// Alerts are keyed by the serial of the Envoy the poll was made on.
+// Notifications are sent in the background, a slow notifier mustn't hold up
+// the polls of the other Envoys, but in the order they were raised.
+func evaluateAlerts(result pollResult) {
+	if !config.Bool("alerts.enabled") {
+		return
+	}
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	serial := result.Envoy.serial
+	now := time.Now()
+	repeat := time.Duration(config.Int("alerts.repeatHours", 0)) * time.Hour
+
+	stateMutex.Lock()
+	active := make(map[string]activeAlert, len(state.Alerts))
+	for key, alert := range state.Alerts {
+		active[key] = alert
+	}
+	stateMutex.Unlock()
+
+	var notifications []alertNotification
+
+	resolve := func(rule string, firingKeys map[string]bool) {
+		for key, alert := range active {
+			if alert.Rule == rule && alert.Serial == serial && !firingKeys[key] {
+				delete(active, key)
+				notifications = append(notifications, alertNotification{Alert: alert, Status: "resolved", Time: now})
+			}
+		}
+	}
+
+	for _, rule := range alertRules {
+		// A rule turned off can't resolve its alerts any more, they'd stay
+		// active for good
+		if !config.Bool("alerts."+rule.configKey+".enabled", true) {
+			resolve(rule.name, nil)
+			continue
+		}
+
+		firing, ok := rule.evaluate(result, now)
+		if !ok {
+			continue
+		}
+
+		firingKeys := map[string]bool{}
+		for _, alert := range firing {
+			alert.Rule = rule.name
+			alert.Serial = serial
+			alert.Key = serial + "/" + alert.Key
+			alert.Summary = result.Envoy.name + ": " + alert.Summary
+			firingKeys[alert.Key] = true
+
+			previous, known := active[alert.Key]
+			switch {
+			case !known:
+				alert.Since = now
+			case repeat > 0 && now.Sub(previous.LastNotified) >= repeat:
+				alert.Since = previous.Since
+			default:
+				continue
+			}
+			alert.LastNotified = now
+			active[alert.Key] = alert
+			notifications = append(notifications, alertNotification{Alert: alert, Status: "firing", Time: now})
+		}
+
+		resolve(rule.name, firingKeys)
+	}
+
+	if len(notifications) == 0 {
+		return
+	}
+
+	for _, notification := range notifications {
+		splunkLogger.WithFields(log.Fields{
+			"event":   "alert",
+			"status":  notification.Status,
+			"rule":    notification.Alert.Rule,
+			"key":     notification.Alert.Key,
+			"serial":  notification.Alert.Serial,
+			"since":   notification.Alert.Since,
+			"summary": notification.Alert.Summary,
+		}).Warnln("Alert " + notification.Status)
+	}
+	queueNotifications(notifications)
+
+	writeStateError := updateState(func(s *collectorState) { s.Alerts = active })
+	if writeStateError != nil {
+		splunkLogger.WithFields(log.Fields{"Error": "Error saving alert state"}).Error(writeStateError)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gookit/config/v2"
+)
+
+// newFakeWebhook collects the status of every notification it receives, the
+// first one is slow to answer
+func newFakeWebhook(t *testing.T) (*httptest.Server, func(count int) []string) {
+	t.Helper()
+	var mutex sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n alertNotification
+		json.NewDecoder(r.Body).Decode(&n)
+		mutex.Lock()
+		first := len(received) == 0
+		mutex.Unlock()
+		if first {
+			time.Sleep(100 * time.Millisecond)
+		}
+		mutex.Lock()
+		received = append(received, n.Alert.Rule+" "+n.Status)
+		mutex.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	wait := func(count int) []string {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			mutex.Lock()
+			if len(received) >= count {
+				mutex.Unlock()
+				break
+			}
+			mutex.Unlock()
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), received...)
+	}
+	return server, wait
+}
+
+func TestAlertNotificationsInOrder(t *testing.T) {
+	setupTest(t)
+	webhook, received := newFakeWebhook(t)
+	config.Set("alerts.enabled", true)
+	config.Set("notifiers.webhook.url", webhook.URL)
+	envoy := newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+	envoy.lastSuccess = time.Now().Add(-time.Hour)
+
+	evaluateAlerts(pollResult{Envoy: envoy, Time: time.Now(), Err: errors.New("connection refused")})
+	evaluateAlerts(pollResult{Envoy: envoy, Time: time.Now(), Reachable: true})
+
+	got := received(2)
+	if len(got) != 2 || got[0] != "envoy_unreachable firing" || got[1] != "envoy_unreachable resolved" {
+		t.Errorf("notifications received %v", got)
+	}
+}
+
+func TestAlertsResolvedWhenRuleDisabled(t *testing.T) {
+	setupTest(t)
+	webhook, received := newFakeWebhook(t)
+	config.Set("alerts.enabled", true)
+	config.Set("notifiers.webhook.url", webhook.URL)
+	envoy := newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+	envoy.lastSuccess = time.Now().Add(-time.Hour)
+	unreachable := pollResult{Envoy: envoy, Time: time.Now(), Err: errors.New("connection refused")}
+
+	evaluateAlerts(unreachable)
+	config.Set("alerts.envoyUnreachable.enabled", false)
+	evaluateAlerts(unreachable)
+
+	stateMutex.Lock()
+	active := len(state.Alerts)
+	stateMutex.Unlock()
+	if active != 0 {
+		t.Errorf("%d alerts still active", active)
+	}
+	if got := received(2); len(got) != 2 || got[1] != "envoy_unreachable resolved" {
+		t.Errorf("notifications received %v", got)
+	}
+}
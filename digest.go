@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// digestChallenge holds the parameters of a WWW-Authenticate: Digest header
+type digestChallenge struct {
+	realm, nonce, opaque, qop, algorithm string
+}
+
+func parseDigestChallenge(header string) (digestChallenge, bool) {
+	scheme, params, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Digest") {
+		return digestChallenge{}, false
+	}
+
+	challenge := digestChallenge{}
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(key) {
+		case "realm":
+			challenge.realm = value
+		case "nonce":
+			challenge.nonce = value
+		case "opaque":
+			challenge.opaque = value
+		case "qop":
+			// Only qop=auth is supported, it's the one the Envoy offers
+			if strings.Contains(value, "auth") {
+				challenge.qop = "auth"
+			}
+		case "algorithm":
+			challenge.algorithm = value
+		}
+	}
+	return challenge, challenge.nonce != ""
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// authorize sets the Authorization header answering the challenge, as
+// described in RFC 2617. Only MD5 is supported, which is all the Envoy uses.
+func (c digestChallenge) authorize(req *http.Request, username, password string) {
+	uri := req.URL.RequestURI()
+	ha1 := md5Hex(username + ":" + c.realm + ":" + password)
+	ha2 := md5Hex(req.Method + ":" + uri)
+
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, username, c.realm, c.nonce, uri)
+
+	if c.qop == "" {
+		header += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+c.nonce+":"+ha2))
+	} else {
+		cnonceBytes := make([]byte, 8)
+		rand.Read(cnonceBytes)
+		cnonce := hex.EncodeToString(cnonceBytes)
+		nc := "00000001"
+		response := md5Hex(ha1 + ":" + c.nonce + ":" + nc + ":" + cnonce + ":" + c.qop + ":" + ha2)
+		header += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s", response="%s"`, c.qop, nc, cnonce, response)
+	}
+	if c.opaque != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, c.opaque)
+	}
+	if c.algorithm != "" {
+		header += ", algorithm=" + c.algorithm
+	}
+
+	req.Header.Set("Authorization", header)
+}
+
+// installerPassword derives the password of the "installer" user from the
+// Envoy serial number, following the algorithm the Enphase installer app
+// uses for pre-token firmware
+func installerPassword(serial string) string {
+	digest := md5Hex("[e]installer@enphaseenergy.com#" + serial + " EnPhAsE eNeRgY ")
+
+	countZero := strings.Count(digest, "0")
+	countOne := strings.Count(digest, "1")
+
+	password := make([]byte, 0, 8)
+	for i := len(digest) - 1; i >= len(digest)-8; i-- {
+		if countZero == 3 || countZero == 6 || countZero == 9 {
+			countZero--
+		}
+		if countZero > 20 {
+			countZero = 20
+		}
+		if countZero < 0 {
+			countZero = 0
+		}
+		if countOne == 9 || countOne == 15 {
+			countOne--
+		}
+		if countOne > 26 {
+			countOne = 26
+		}
+		if countOne < 0 {
+			countOne = 0
+		}
+
+		switch digest[i] {
+		case '0':
+			password = append(password, byte('f'+countZero))
+			countZero--
+		case '1':
+			password = append(password, byte('@'+countOne))
+			countOne--
+		default:
+			password = append(password, digest[i])
+		}
+	}
+	return string(password)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Envoys advertise themselves over mDNS under this service
+const envoyMDNSService = "_enphase-envoy._tcp.local."
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// discoveredEnvoy is one Envoy that answered the mDNS query
+type discoveredEnvoy struct {
+	Instance string
+	Serial   string
+	Host     string
+	Software string
+}
+
+func discoveryEnabled() bool {
+	return config.Bool("enphase.discovery.enabled")
+}
+
+func discoveryTimeout() time.Duration {
+	return time.Duration(config.Int("enphase.discovery.timeoutSeconds", 3)) * time.Second
+}
+
+// discoverEnvoys asks the LAN for _enphase-envoy._tcp and collects answers
+// until timeout. The query is sent from an ephemeral port, so responders
+// answer us directly (RFC 6762 legacy unicast) rather than to the group.
+// When the TXT record carries no serial it is read from /info.xml.
+func discoverEnvoys(timeout time.Duration) ([]discoveredEnvoy, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	name, err := dnsmessage.NewName(envoyMDNSService)
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(packet, mdnsGroup); err != nil {
+		return nil, err
+	}
+
+	found := map[string]*discoveredEnvoy{}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netError net.Error
+			if errors.As(err, &netError) && netError.Timeout() {
+				break
+			}
+			return nil, err
+		}
+
+		var answer dnsmessage.Message
+		if answer.Unpack(buf[:n]) != nil {
+			continue
+		}
+		collectMDNSAnswer(answer, from.IP, found)
+	}
+
+	envoys := make([]discoveredEnvoy, 0, len(found))
+	for _, envoy := range found {
+		if envoy.Serial == "" || envoy.Software == "" {
+			// /info.xml carries no secret, the certificate can't be pinned
+			// before we know which Envoy this is
+			probe := &envoyClient{baseURL: envoy.Host, client: &http.Client{
+				Timeout:   httpTimeout,
+				Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+			}}
+			if info, err := probe.loadInfo(); err == nil {
+				envoy.Serial = info.Device.Serial
+				envoy.Software = info.Device.Software
+			}
+		}
+		envoys = append(envoys, *envoy)
+	}
+	sort.Slice(envoys, func(i, j int) bool { return envoys[i].Serial < envoys[j].Serial })
+
+	return envoys, nil
+}
+
+// collectMDNSAnswer adds the instances of our service found in one response.
+// The address the response came from is the Envoy's, so A records and SRV
+// targets are not needed.
+func collectMDNSAnswer(answer dnsmessage.Message, from net.IP, found map[string]*discoveredEnvoy) {
+	instance := func(name string) *discoveredEnvoy {
+		if found[name] == nil {
+			found[name] = &discoveredEnvoy{Instance: strings.TrimSuffix(name, "."+envoyMDNSService), Host: "https://" + from.String()}
+		}
+		return found[name]
+	}
+
+	for _, resource := range append(answer.Answers, answer.Additionals...) {
+		switch body := resource.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if strings.EqualFold(resource.Header.Name.String(), envoyMDNSService) {
+				instance(body.PTR.String())
+			}
+		case *dnsmessage.TXTResource:
+			if !strings.HasSuffix(strings.ToLower(resource.Header.Name.String()), envoyMDNSService) {
+				continue
+			}
+			envoy := instance(resource.Header.Name.String())
+			for _, txt := range body.TXT {
+				key, value, _ := strings.Cut(txt, "=")
+				switch strings.ToLower(key) {
+				case "serialnum", "serial":
+					envoy.Serial = value
+				case "software", "firmware":
+					envoy.Software = value
+				}
+			}
+		}
+	}
+}
+
+// rediscover looks for this Envoy's serial on the LAN and moves the client to
+// the address it answers on now, e.g. after DHCP handed it a new one
+func (e *envoyClient) rediscover() bool {
+	if !discoveryEnabled() || e.serial == "" {
+		return false
+	}
+
+	envoys, err := discoverEnvoys(discoveryTimeout())
+	if err != nil {
+		e.logger.WithFields(log.Fields{"Error": "Error discovering Envoys"}).Error(err)
+		return false
+	}
+
+	for _, envoy := range envoys {
+		if envoy.Serial != e.serial {
+			continue
+		}
+		if envoy.Host == e.baseURL {
+			return false
+		}
+		e.logger.WithFields(log.Fields{"previousHost": e.baseURL, "host": envoy.Host}).Warnln("Envoy found at a new address")
+		e.baseURL = envoy.Host
+		e.digestMutex.Lock()
+		e.digest = nil
+		e.digestMutex.Unlock()
+		return true
+	}
+
+	e.logger.WithField("discovered", len(envoys)).Warnln("Envoy not found by mDNS discovery")
+	return false
+}
+
+// runDiscoverCommand implements the discover command: it lists the Envoys
+// answering on the LAN and whether they are configured
+func runDiscoverCommand() {
+	envoys, err := discoverEnvoys(discoveryTimeout())
+	if err != nil {
+		splunkLogger.WithFields(log.Fields{"Error": "Error discovering Envoys"}).Fatalln(err)
+	}
+
+	configured := map[string]string{}
+	for _, envoy := range configuredEnvoys() {
+		configured[envoy.serial] = envoy.name
+	}
+
+	if len(envoys) == 0 {
+		fmt.Fprintln(os.Stderr, "No Envoy answered, mDNS needs the collector on the same LAN (host networking in Docker)")
+		return
+	}
+
+	fmt.Printf("%-14s %-24s %-12s %s\n", "SERIAL", "HOST", "FIRMWARE", "CONFIGURED AS")
+	for _, envoy := range envoys {
+		name, ok := configured[envoy.Serial]
+		if !ok {
+			name = "-"
+		}
+		fmt.Printf("%-14s %-24s %-12s %s\n", envoy.Serial, envoy.Host, envoy.Software, name)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+// How calls to the local API are authenticated, older firmware predates tokens
+const (
+	envoyAuthNone   = "none"
+	envoyAuthDigest = "digest"
+	envoyAuthJWT    = "jwt"
+)
+
+// envoyInfo is the part of /info.xml we use, it is served without any auth
+// on every firmware
+type envoyInfo struct {
+	Device struct {
+		Serial     string `xml:"sn"`
+		PartNumber string `xml:"pn"`
+		Software   string `xml:"software"`
+		Imeter     bool   `xml:"imeter"`
+	} `xml:"device"`
+	WebTokens bool `xml:"web-tokens"`
+}
+
+// firmwareMajor turns a software version such as D7.0.88 or R4.10.35 into 7 or 4
+func (info envoyInfo) firmwareMajor() int {
+	version := strings.TrimLeft(info.Device.Software, "ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	major, _, _ := strings.Cut(version, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// envoyClient makes calls to the local API of one Envoy with whatever
+// authentication its firmware expects, and carries what the collector knows
+// about that Envoy between polls
+type envoyClient struct {
+	configPrefix string
+	name         string
+	serial       string
+	baseURL      string
+	logger       *log.Entry
+	client       *http.Client
+
+	auth         string
+	authDetected bool
+	token        string
+	tokenExpiry  time.Time
+	username     string
+	password     string
+	lastSuccess  time.Time
+	meters       map[int64]envoyMeter
+	powerQuality *powerQualityTracker
+	lastEvents   time.Time
+	// info is the last /info.xml read, infoRead tells whether there was one
+	info     envoyInfo
+	infoRead bool
+
+	counters           map[string]*counterCheck
+	maxActiveInverters int
+
+	digestMutex sync.Mutex
+	digest      *digestChallenge
+}
+
+// configuredEnvoys returns a client for every entry of enphase.envoys or, on
+// configs from before several Envoys were supported, for the single Envoy
+// described directly under enphase. An incomplete entry stops the collector.
+func configuredEnvoys() []*envoyClient {
+	var envoys []*envoyClient
+
+	if list, ok := config.Get("enphase.envoys").([]interface{}); ok && len(list) > 0 {
+		for i := range list {
+			configPrefix := fmt.Sprintf("enphase.envoys.%d", i)
+			if err := checkEnvoyEntry(configPrefix); err != nil {
+				splunkLogger.WithField("envoy", configPrefix).Fatalln(err)
+			}
+			envoys = append(envoys, newEnvoyClient(configPrefix))
+		}
+	} else {
+		envoys = append(envoys, newEnvoyClient("enphase"))
+	}
+
+	return envoys
+}
+
+// checkEnvoyEntry makes sure an entry of enphase.envoys says which Envoy it
+// is: its serial and host never fall back to those under enphase, that would
+// poll another Envoy twice under a second name
+func checkEnvoyEntry(configPrefix string) error {
+	if config.String(configPrefix+".EnphaseEnvoySerial") == "" {
+		return fmt.Errorf("%s has no EnphaseEnvoySerial", configPrefix)
+	}
+	if config.String(configPrefix+".EnvoyHost") == "" && !discoveryEnabled() {
+		return fmt.Errorf("%s has no EnvoyHost, and discovery isn't enabled", configPrefix)
+	}
+	return nil
+}
+
+// newEnvoyClient reads the Envoy configured under configPrefix. EnvoyHost
+// may be left out when mDNS discovery is enabled.
+func newEnvoyClient(configPrefix string) *envoyClient {
+	e := &envoyClient{
+		configPrefix: configPrefix,
+		auth:         envoyAuthJWT,
+		lastSuccess:  time.Now(),
+	}
+	e.serial = e.ownSetting("EnphaseEnvoySerial")
+	e.baseURL = strings.TrimSuffix(e.ownSetting("EnvoyHost"), "/")
+	e.name = e.setting("name", e.setting("EnphaseSite", e.serial))
+	e.logger = splunkLogger.WithFields(log.Fields{"serial": e.serial, "site": e.name})
+	e.client = &http.Client{Timeout: httpTimeout, Transport: e.transport()}
+
+	return e
+}
+
+// setting reads key from this Envoy's config, falling back to the value
+// directly under enphase so credentials can be shared by all Envoys
+func (e *envoyClient) setting(key string, defVal ...string) string {
+	if value := e.ownSetting(key); value != "" {
+		return value
+	}
+	return config.String("enphase."+key, defVal...)
+}
+
+// ownSetting reads key from this Envoy's config only, for what identifies
+// one Envoy and can't be shared: its serial, host and certificate
+func (e *envoyClient) ownSetting(key string) string {
+	return config.String(e.configPrefix + "." + key)
+}
+
+func (e *envoyClient) settingBool(key string, defVal ...bool) bool {
+	return config.Bool(e.configPrefix+"."+key, config.Bool("enphase."+key, defVal...))
+}
+
+func (e *envoyClient) settingInt(key string, defVal ...int) int {
+	return config.Int(e.configPrefix+"."+key, config.Int("enphase."+key, defVal...))
+}
+
+// secret is setting for credentials, see the secret function
+func (e *envoyClient) secret(key string) string {
+	if value := secret(e.configPrefix + "." + key); value != "" {
+		return value
+	}
+	return secret("enphase." + key)
+}
+
+// get calls path on the Envoy. Without JWTs a 401 carrying a fresh digest
+// challenge is answered once, which also copes with expired nonces and with
+// the endpoints of pre-token firmware that want digest auth when others
+// don't. With JWTs a 401 means the Envoy no longer takes the token, it is
+// dropped so the next poll fetches a new one.
+func (e *envoyClient) get(path string) (*http.Response, error) {
+	res, err := e.do(path)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	if e.auth == envoyAuthJWT {
+		e.dropToken()
+		return res, nil
+	}
+
+	challenge, ok := parseDigestChallenge(res.Header.Get("WWW-Authenticate"))
+	res.Body.Close()
+	if !ok {
+		return nil, fmt.Errorf("envoy answered %s to %s without a digest challenge", res.Status, path)
+	}
+
+	e.digestMutex.Lock()
+	e.digest = &challenge
+	e.digestMutex.Unlock()
+
+	return e.do(path)
+}
+
+func (e *envoyClient) do(path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", e.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.auth {
+	case envoyAuthJWT:
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", e.token))
+	case envoyAuthDigest, envoyAuthNone:
+		e.digestMutex.Lock()
+		if e.digest != nil {
+			e.digest.authorize(req, e.username, e.password)
+		}
+		e.digestMutex.Unlock()
+	}
+
+	return e.client.Do(req)
+}
+
+// getBody calls path and returns the body of a 200 response, recording it
+// under source when running with --record
+func (e *envoyClient) getBody(path string, source string) ([]byte, error) {
+	res, err := e.get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("envoy %s returned %s", path, res.Status)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	recordResponse(source, e.serial, body)
+
+	return body, nil
+}
+
+func (e *envoyClient) loadInfo() (envoyInfo, error) {
+	info := envoyInfo{}
+
+	res, err := e.client.Get(e.baseURL + "/info.xml")
+	if err != nil {
+		return info, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("envoy info endpoint returned %s", res.Status)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return info, err
+	}
+
+	if err := xml.Unmarshal(body, &info); err != nil {
+		return info, err
+	}
+	e.info, e.infoRead = info, true
+	return info, nil
+}
+
+// hasMeters tells whether the Envoy has CTs, as /info.xml says: Envoy S
+// Standard and IQ Gateways without metering have no /ivp/meters worth
+// polling. Envoys whose /info.xml can't be read are assumed to have some.
+func (e *envoyClient) hasMeters() bool {
+	if !e.infoRead {
+		if _, err := e.loadInfo(); err != nil {
+			return true
+		}
+	}
+	return e.info.Device.Imeter
+}
+
+// detectAuth picks the authentication from authMode, or with "auto" (the
+// default) from the firmware reported in /info.xml: D7 and later use
+// Enlighten JWTs. Older firmware needs no auth when /production.json answers
+// without a challenge, HTTP digest auth otherwise. When /info.xml can't be
+// read JWT is assumed and detection is tried again on the next poll.
+func (e *envoyClient) detectAuth() {
+	mode := e.setting("authMode", "auto")
+
+	if mode == "auto" {
+		info, err := e.loadInfo()
+		if err != nil {
+			e.logger.WithFields(log.Fields{"Error": "Error reading /info.xml, assuming token based firmware"}).Warn(err)
+			mode = envoyAuthJWT
+		} else {
+			e.authDetected = true
+			switch {
+			case info.WebTokens || info.firmwareMajor() >= 7:
+				mode = envoyAuthJWT
+			case e.answersWithoutAuth("/production.json"):
+				mode = envoyAuthNone
+			default:
+				mode = envoyAuthDigest
+			}
+			e.logger.WithFields(log.Fields{"firmware": info.Device.Software, "webTokens": info.WebTokens, "auth": mode}).Infoln("Detected Envoy firmware")
+		}
+	} else {
+		e.authDetected = true
+	}
+
+	e.auth = mode
+
+	if mode != envoyAuthJWT {
+		e.username = e.setting("envoyUsername", "envoy")
+		e.password = e.secret("envoyPassword")
+		if e.password == "" {
+			e.password = defaultEnvoyPassword(e.username, e.serial)
+			registerSecret(e.password)
+		}
+	}
+}
+
+// answersWithoutAuth tells whether path is served without any credentials.
+// A 401 or a network error means auth is needed, or might be.
+func (e *envoyClient) answersWithoutAuth(path string) bool {
+	res, err := e.client.Get(e.baseURL + path)
+	if err != nil {
+		e.logger.WithFields(log.Fields{"Error": "Error probing " + path + " without auth"}).Warn(err)
+		return false
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	return res.StatusCode == http.StatusOK && res.Header.Get("WWW-Authenticate") == ""
+}
+
+// ensureToken makes sure a JWT Envoy has an unexpired token, reading it from
+// state or fetching a new one from Enlighten
+func (e *envoyClient) ensureToken() error {
+	if e.auth != envoyAuthJWT || (e.token != "" && e.tokenExpiry.After(time.Now())) {
+		return nil
+	}
+
+	jwt, err := loadLongLivedJWT(e)
+	if err != nil {
+		return err
+	}
+	e.token = jwt.Token
+	e.tokenExpiry = time.Unix(int64(jwt.ExpiresAt), 0)
+	return nil
+}
+
+// dropToken forgets a token the Envoy rejected before it expired, it may
+// have been revoked or issued for another Envoy. The copy in state is marked
+// expired rather than removed, so the token once kept in config.yaml isn't
+// picked up again either.
+func (e *envoyClient) dropToken() {
+	if e.token == "" {
+		return
+	}
+	rejected := e.token
+	e.token = ""
+	e.tokenExpiry = time.Time{}
+	e.logger.Warnln("The Envoy rejected the JWT, a new one will be fetched from Enlighten")
+
+	writeStateError := updateState(func(s *collectorState) {
+		if envoyState := s.envoyStateFor(e.serial); envoyState.JWT.Token == rejected {
+			envoyState.JWT.ExpiresAt = 0
+		}
+	})
+	if writeStateError != nil {
+		e.logger.WithFields(log.Fields{"writeStateError": writeStateError, "stateFile": stateFilePath()}).Errorln("Error writing state file")
+	}
+}
+
+// defaultEnvoyPassword is the factory password of the local users on
+// pre-token firmware: the last six digits of the serial for "envoy", a
+// password derived from the serial for "installer"
+func defaultEnvoyPassword(username string, serial string) string {
+	switch username {
+	case "installer":
+		return installerPassword(serial)
+	default:
+		if len(serial) < 6 {
+			return serial
+		}
+		return serial[len(serial)-6:]
+	}
+}
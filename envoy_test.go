@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gookit/config/v2"
+)
+
+func TestDetectAuth(t *testing.T) {
+	preTokenInfo := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<?xml version='1.0' encoding='UTF-8'?><envoy_info><device><sn>122012345678</sn><software>R4.10.35</software></device></envoy_info>`))
+	}
+	openProduction := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fixture(t, "envoy/production.json"))
+	}
+	digestProduction := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Digest realm="enphaseenergy.com", qop="auth", nonce="4f2c1a"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	tests := []struct {
+		name     string
+		handlers map[string]http.HandlerFunc
+		expected string
+	}{
+		{"token firmware", nil, envoyAuthJWT},
+		{"pre-token firmware, open API", map[string]http.HandlerFunc{"/info.xml": preTokenInfo, "/production.json": openProduction}, envoyAuthNone},
+		{"pre-token firmware, digest challenge", map[string]http.HandlerFunc{"/info.xml": preTokenInfo, "/production.json": digestProduction}, envoyAuthDigest},
+		{"no info.xml", map[string]http.HandlerFunc{"/info.xml": http.NotFound}, envoyAuthJWT},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			envoy := newTestEnvoy(t, newFakeEnvoy(t, test.handlers).URL, "http://enlighten.invalid")
+
+			envoy.detectAuth()
+			if envoy.auth != test.expected {
+				t.Errorf("detected %q, want %q", envoy.auth, test.expected)
+			}
+			if detected := test.name != "no info.xml"; envoy.authDetected != detected {
+				t.Errorf("authDetected %v, want %v", envoy.authDetected, detected)
+			}
+		})
+	}
+}
+
+func TestCheckEnvoyEntry(t *testing.T) {
+	tests := []struct {
+		name      string
+		entry     map[string]interface{}
+		discovery bool
+		valid     bool
+	}{
+		{"complete", map[string]interface{}{"EnphaseEnvoySerial": "122012340001", "EnvoyHost": "https://10.0.1.190"}, false, true},
+		{"no serial", map[string]interface{}{"EnvoyHost": "https://10.0.1.190"}, false, false},
+		{"no host", map[string]interface{}{"EnphaseEnvoySerial": "122012340001"}, false, false},
+		{"no host, discovered", map[string]interface{}{"EnphaseEnvoySerial": "122012340001"}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			newTestEnvoy(t, "https://10.0.0.190", "https://enlighten.invalid")
+			config.Set("enphase.discovery.enabled", test.discovery)
+			config.Set("enphase.envoys", []interface{}{test.entry})
+
+			err := checkEnvoyEntry("enphase.envoys.0")
+			if (err == nil) != test.valid {
+				t.Fatalf("checkEnvoyEntry: %v", err)
+			}
+			if !test.valid {
+				return
+			}
+			envoy := newEnvoyClient("enphase.envoys.0")
+			if envoy.serial != "122012340001" || envoy.baseURL == "https://10.0.0.190" {
+				t.Errorf("entry polls %s at %q", envoy.serial, envoy.baseURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// envoyHome is the part of /home.json describing the Envoy itself
+type envoyHome struct {
+	Network struct {
+		WebComm                 bool   `json:"web_comm"`
+		EverReportedToEnlighten bool   `json:"ever_reported_to_enlighten"`
+		LastEnlightenReportTime int64  `json:"last_enlighten_report_time"`
+		PrimaryInterface        string `json:"primary_interface"`
+		Interfaces              []struct {
+			Type              string `json:"type"`
+			Interface         string `json:"interface"`
+			Carrier           bool   `json:"carrier"`
+			SignalStrength    int    `json:"signal_strength"`
+			SignalStrengthMax int    `json:"signal_strength_max"`
+		} `json:"interfaces"`
+	} `json:"network"`
+	Comm struct {
+		Num   int           `json:"num"`
+		Level int           `json:"level"`
+		PCU   envoyCommLink `json:"pcu"`
+		ACB   envoyCommLink `json:"acb"`
+		NSRB  envoyCommLink `json:"nsrb"`
+		ESUB  envoyCommLink `json:"esub"`
+	} `json:"comm"`
+	Alerts []struct {
+		MsgKey string `json:"msg_key"`
+	} `json:"alerts"`
+	UpdateStatus string `json:"update_status"`
+}
+
+// envoyCommLink is the number of devices of one kind and the power line
+// communication level to them, 0 to 5
+type envoyCommLink struct {
+	Num   int `json:"num"`
+	Level int `json:"level"`
+}
+
+func loadEnvoyHome(envoy *envoyClient) (envoyHome, error) {
+	home := envoyHome{}
+	body, err := envoy.getBody("/home.json", "home")
+	if err != nil {
+		return home, err
+	}
+	return home, json.Unmarshal(body, &home)
+}
+
+// writeEnvoyStatus writes how the Envoy itself is doing to envoy_status:
+// firmware, network interfaces, communication with the microinverters and
+// other devices, Enlighten reporting and alarms. A firmware change is
+// logged as an event, and makes the next poll detect the authentication
+// again since updates have moved Envoys from digest auth to tokens.
+func writeEnvoyStatus(envoy *envoyClient, now time.Time) int {
+	info, infoError := envoy.loadInfo()
+	if infoError != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error loading /info.xml"}).Warn(infoError)
+		return 0
+	}
+	home, homeError := loadEnvoyHome(envoy)
+	if homeError != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error loading /home.json"}).Warn(homeError)
+	}
+
+	trackFirmware(envoy, info)
+
+	fields := map[string]interface{}{
+		"firmware":   info.Device.Software,
+		"partNumber": info.Device.PartNumber,
+		"imeter":     info.Device.Imeter,
+	}
+
+	if homeError == nil {
+		fields["webComm"] = home.Network.WebComm
+		fields["primaryInterface"] = home.Network.PrimaryInterface
+		if home.Network.LastEnlightenReportTime > 0 {
+			fields["enlightenReportAgeSeconds"] = now.Unix() - home.Network.LastEnlightenReportTime
+		}
+		for _, networkInterface := range home.Network.Interfaces {
+			name := networkInterface.Type
+			fields[name+"Carrier"] = networkInterface.Carrier
+			if networkInterface.SignalStrengthMax > 0 {
+				fields[name+"Signal"] = networkInterface.SignalStrength
+				fields[name+"SignalMax"] = networkInterface.SignalStrengthMax
+			}
+		}
+		fields["commNum"] = home.Comm.Num
+		fields["commLevel"] = home.Comm.Level
+		for name, link := range map[string]envoyCommLink{"pcu": home.Comm.PCU, "acb": home.Comm.ACB, "nsrb": home.Comm.NSRB, "esub": home.Comm.ESUB} {
+			if link.Num > 0 {
+				fields[name+"Num"] = link.Num
+				fields[name+"CommLevel"] = link.Level
+			}
+		}
+		alerts := make([]string, 0, len(home.Alerts))
+		for _, alert := range home.Alerts {
+			alerts = append(alerts, alert.MsgKey)
+		}
+		fields["alertCount"] = len(alerts)
+		fields["alerts"] = strings.Join(alerts, ",")
+		fields["updateStatus"] = home.UpdateStatus
+	}
+
+	tags := map[string]string{"serial": envoy.serial, "site": envoy.name}
+	if writeToInfluxDB(influxDBcnx, "envoy_status", tags, fields, now) != nil {
+		return 1
+	}
+	return 0
+}
+
+// trackFirmware compares the firmware with the one seen last, kept in state
+func trackFirmware(envoy *envoyClient, info envoyInfo) {
+	firmware := info.Device.Software
+	if firmware == "" {
+		return
+	}
+
+	stateMutex.Lock()
+	previous := state.envoyStateFor(envoy.serial).Firmware
+	stateMutex.Unlock()
+	if previous == firmware {
+		return
+	}
+
+	writeStateError := updateState(func(s *collectorState) { s.envoyStateFor(envoy.serial).Firmware = firmware })
+	if writeStateError != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error saving firmware to state"}).Error(writeStateError)
+	}
+	if previous == "" {
+		return
+	}
+	envoy.logger.WithFields(log.Fields{"event": "firmware_change", "previousFirmware": previous, "firmware": firmware}).Warnln("Envoy firmware changed")
+	if envoy.setting("authMode", "auto") == "auto" {
+		envoy.authDetected = false
+	}
+}
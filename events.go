@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// envoyEvent is one entry of the Envoy event log
+type envoyEvent struct {
+	ID          int64
+	Description string
+	Device      string
+	DeviceType  string
+	Time        time.Time
+}
+
+// eventTimeLayouts are the ways firmware versions print event times, in the
+// Envoy's own timezone
+var eventTimeLayouts = []string{
+	"Mon Jan 2, 2006 03:04 PM MST",
+	"Mon Jan 2, 2006 15:04 MST",
+	"Mon Jan _2 15:04:05 MST 2006",
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+}
+
+// decodeEnvoyEvents decodes the event log table. Rows are id, description,
+// device serial, device type and time, as the installer pages show them.
+// Rows that can't be read are skipped.
+func decodeEnvoyEvents(body []byte) ([]envoyEvent, error) {
+	var table struct {
+		AaData [][]interface{} `json:"aaData"`
+		Data   [][]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &table); err != nil {
+		return nil, err
+	}
+	rows := table.AaData
+	if rows == nil {
+		rows = table.Data
+	}
+
+	var events []envoyEvent
+	for _, row := range rows {
+		if len(row) < 5 {
+			continue
+		}
+		id, err := strconv.ParseInt(fmt.Sprint(row[0]), 10, 64)
+		if err != nil {
+			continue
+		}
+		event := envoyEvent{
+			ID:          id,
+			Description: strings.TrimSpace(fmt.Sprint(row[1])),
+			Device:      strings.TrimSpace(fmt.Sprint(row[2])),
+			DeviceType:  strings.TrimSpace(fmt.Sprint(row[3])),
+		}
+		timestamp := strings.TrimSpace(fmt.Sprint(row[4]))
+		for _, layout := range eventTimeLayouts {
+			if t, err := time.ParseInLocation(layout, timestamp, siteLocation()); err == nil {
+				event.Time = t
+				break
+			}
+		}
+		events = append(events, event)
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+// loadEnvoyEvents reads the event log every events.intervalMinutes and
+// writes the events newer than the last one written, which is kept in state
+// so a restart doesn't write them again
+func loadEnvoyEvents(envoy *envoyClient, now time.Time) int {
+	if now.Sub(envoy.lastEvents) < time.Duration(envoy.settingInt("events.intervalMinutes", 5))*time.Minute {
+		return 0
+	}
+	envoy.lastEvents = now
+
+	path := fmt.Sprintf("/datatab/event_dt.rb?start=0&length=%d", envoy.settingInt("events.maxEvents", 200))
+	body, err := envoy.getBody(path, "events")
+	if err != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error loading the event log"}).Warn(err)
+		return 0
+	}
+	events, err := decodeEnvoyEvents(body)
+	if err != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error decoding the event log"}).Warn(err)
+		return 0
+	}
+
+	stateMutex.Lock()
+	lastEventID := state.envoyStateFor(envoy.serial).LastEventID
+	stateMutex.Unlock()
+
+	// A log whose newest event is older than the last one written has been
+	// cleared, by a reset or a replaced Envoy
+	if len(events) > 0 && events[len(events)-1].ID < lastEventID {
+		envoy.logger.WithFields(log.Fields{"lastEventID": lastEventID, "newestEventID": events[len(events)-1].ID}).Warnln("Envoy event log was reset")
+		lastEventID = 0
+	}
+
+	var fresh []envoyEvent
+	for _, event := range events {
+		if event.ID > lastEventID {
+			fresh = append(fresh, event)
+		}
+	}
+	newest, writeErrors := writeEnvoyEvents(envoy, fresh, now, 0)
+	if newest != 0 {
+		writeStateError := updateState(func(s *collectorState) { s.envoyStateFor(envoy.serial).LastEventID = newest })
+		if writeStateError != nil {
+			envoy.logger.WithFields(log.Fields{"Error": "Error saving last event id to state"}).Error(writeStateError)
+		}
+	}
+	return writeErrors
+}
+
+// writeEnvoyEvents logs and writes events to envoy_events, returning the id
+// of the last one written before any write error so the others are retried
+// on the next poll. The title, text and tags fields are what Grafana
+// annotations read.
+func writeEnvoyEvents(envoy *envoyClient, events []envoyEvent, now time.Time, shift time.Duration) (int64, int) {
+	var newest int64
+	for _, event := range events {
+		eventTime := event.Time
+		if eventTime.IsZero() {
+			eventTime = now
+		}
+		// Event times only have minute resolution, spreading events by id
+		// keeps those of the same minute from overwriting each other
+		eventTime = eventTime.Add(shift + time.Duration(event.ID%1000)*time.Millisecond)
+
+		envoy.logger.WithFields(log.Fields{
+			"event":      "envoy_event",
+			"eventID":    event.ID,
+			"device":     event.Device,
+			"deviceType": event.DeviceType,
+			"eventTime":  eventTime,
+		}).Infoln(event.Description)
+
+		tags := map[string]string{"serial": envoy.serial, "site": envoy.name, "deviceType": event.DeviceType}
+		fields := map[string]interface{}{
+			"eventID": event.ID,
+			"title":   event.Description,
+			"text":    strings.TrimSpace(event.Description + " " + event.Device),
+			"tags":    strings.Trim(envoy.name+","+event.DeviceType, ","),
+			"device":  event.Device,
+		}
+		if writeToInfluxDB(influxDBcnx, "envoy_events", tags, fields, eventTime) != nil {
+			return newest, 1
+		}
+		newest = event.ID
+	}
+	return newest, 0
+}
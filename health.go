@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+// healthStatus tracks when the collector last did something useful so
+// orchestrators can tell a stuck ticker loop from a working one
+type healthStatus struct {
+	mutex           sync.Mutex
+	started         time.Time
+	lastInfluxWrite time.Time
+	envoys          map[string]*envoyHealth
+}
+
+// envoyHealth is tracked per Envoy serial
+type envoyHealth struct {
+	LastPoll     time.Time `json:"lastPoll"`
+	JWTExpiresAt time.Time `json:"jwtExpiresAt,omitempty"`
+	jwtRequired  bool
+}
+
+var health = &healthStatus{started: time.Now(), envoys: map[string]*envoyHealth{}}
+
+// envoyHealthFor must be called with health.mutex held
+func envoyHealthFor(serial string) *envoyHealth {
+	if health.envoys[serial] == nil {
+		health.envoys[serial] = &envoyHealth{}
+	}
+	return health.envoys[serial]
+}
+
+// registerEnvoyHealth makes readiness wait for a first poll of this Envoy
+func registerEnvoyHealth(serial string) {
+	health.mutex.Lock()
+	envoyHealthFor(serial)
+	health.mutex.Unlock()
+}
+
+func recordEnvoyPoll(serial string) {
+	health.mutex.Lock()
+	envoyHealthFor(serial).LastPoll = time.Now()
+	health.mutex.Unlock()
+}
+
+func recordInfluxWrite() {
+	health.mutex.Lock()
+	health.lastInfluxWrite = time.Now()
+	health.mutex.Unlock()
+}
+
+func recordJWTExpiry(serial string, expiresAt time.Time) {
+	health.mutex.Lock()
+	envoyHealth := envoyHealthFor(serial)
+	envoyHealth.JWTExpiresAt = expiresAt
+	envoyHealth.jwtRequired = true
+	health.mutex.Unlock()
+}
+
+type readiness struct {
+	Ready           bool                   `json:"ready"`
+	Reasons         []string               `json:"reasons,omitempty"`
+	LastInfluxWrite time.Time              `json:"lastInfluxWrite"`
+	Envoys          map[string]envoyHealth `json:"envoys"`
+}
+
+// checkReadiness fails when the last poll of any Envoy or the last InfluxDB
+// write is older than health.maxAgeMinutes (three polling periods by
+// default), or when a JWT expires within health.jwtMinRemainingHours
+func checkReadiness(now time.Time) readiness {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	maxAge := time.Duration(config.Int("health.maxAgeMinutes", 3*config.Int("influxdb.periodInMinutes", 1))) * time.Minute
+	jwtMinRemaining := time.Duration(config.Int("health.jwtMinRemainingHours", 24)) * time.Hour
+
+	status := readiness{
+		Ready:           true,
+		LastInfluxWrite: health.lastInfluxWrite,
+		Envoys:          map[string]envoyHealth{},
+	}
+
+	checkAge := func(what string, last time.Time) {
+		switch {
+		case last.IsZero() && now.Sub(health.started) > maxAge:
+			status.Reasons = append(status.Reasons, fmt.Sprintf("no successful %s since start %s ago", what, now.Sub(health.started).Round(time.Second)))
+		case !last.IsZero() && now.Sub(last) > maxAge:
+			status.Reasons = append(status.Reasons, fmt.Sprintf("last successful %s was %s ago, more than %s", what, now.Sub(last).Round(time.Second), maxAge))
+		case last.IsZero():
+			status.Reasons = append(status.Reasons, fmt.Sprintf("waiting for the first %s", what))
+		}
+	}
+
+	serials := make([]string, 0, len(health.envoys))
+	for serial := range health.envoys {
+		serials = append(serials, serial)
+	}
+	sort.Strings(serials)
+
+	for _, serial := range serials {
+		envoyHealth := health.envoys[serial]
+		status.Envoys[serial] = *envoyHealth
+
+		checkAge("poll of Envoy "+serial, envoyHealth.LastPoll)
+
+		// Firmware older than D7 doesn't use tokens at all
+		switch {
+		case !envoyHealth.jwtRequired:
+		case envoyHealth.JWTExpiresAt.Before(now):
+			status.Reasons = append(status.Reasons, fmt.Sprintf("JWT of Envoy %s expired at %s", serial, envoyHealth.JWTExpiresAt.Format(time.RFC3339)))
+		case envoyHealth.JWTExpiresAt.Sub(now) < jwtMinRemaining:
+			status.Reasons = append(status.Reasons, fmt.Sprintf("JWT of Envoy %s expires at %s, in less than %s", serial, envoyHealth.JWTExpiresAt.Format(time.RFC3339), jwtMinRemaining))
+		}
+	}
+	checkAge("InfluxDB write", health.lastInfluxWrite)
+
+	status.Ready = len(status.Reasons) == 0
+	return status
+}
+
+func writeHealthJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// startHealthServer serves /healthz (the process is alive) and /readyz (the
+// collector is actually collecting) on health.listen, ":8080" by default.
+// An empty health.listen disables it.
+func startHealthServer() {
+	listen := config.String("health.listen", ":8080")
+	if listen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := checkReadiness(time.Now())
+		code := http.StatusOK
+		if !status.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeHealthJSON(w, code, status)
+	})
+
+	go func() {
+		splunkLogger.WithField("listen", listen).Infoln("Serving /healthz and /readyz")
+		err := http.ListenAndServe(listen, mux)
+		splunkLogger.WithFields(log.Fields{"Error": "Health endpoint stopped", "listen": listen}).Error(err)
+	}()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pdmDevice is one device of /ivp/pdm/device_data, keyed there by device
+// id next to a few counters that aren't devices
+type pdmDevice struct {
+	DevName  string `json:"devName"`
+	SN       string `json:"sn"`
+	Active   bool   `json:"active"`
+	ModGone  bool   `json:"modGone"`
+	Channels []struct {
+		ChanEid int64 `json:"chanEid"`
+		Watts   struct {
+			Now float64 `json:"now"`
+			Max float64 `json:"max"`
+		} `json:"watts"`
+		Lifetime struct {
+			JoulesProduced float64 `json:"joulesProduced"`
+		} `json:"lifetime"`
+		LastReading struct {
+			EndDate          int64   `json:"endDate"`
+			AcVoltageINmV    float64 `json:"acVoltageINmV"`
+			AcFrequencyINmHz float64 `json:"acFrequencyINmHz"`
+			DcVoltageINmV    float64 `json:"dcVoltageINmV"`
+			DcCurrentINmA    float64 `json:"dcCurrentINmA"`
+			ChannelTemp      float64 `json:"channelTemp"`
+			PwrConvErrSecs   float64 `json:"pwrConvErrSecs"`
+		} `json:"lastReading"`
+	} `json:"channels"`
+}
+
+func decodeDeviceData(body []byte) ([]pdmDevice, error) {
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, err
+	}
+
+	var devices []pdmDevice
+	for _, entry := range entries {
+		device := pdmDevice{}
+		if json.Unmarshal(entry, &device) != nil || device.SN == "" {
+			continue
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// loadCommLevels reads the communication level of every microinverter from
+// /ivp/peb/devstatus, a table of fields and rows per device type. Firmware
+// versions name the column differently, those we know are tried in turn.
+func loadCommLevels(envoy *envoyClient) (map[string]float64, error) {
+	body, err := envoy.getBody("/ivp/peb/devstatus", "devstatus")
+	if err != nil {
+		return nil, err
+	}
+
+	var devstatus map[string]struct {
+		Fields []string        `json:"fields"`
+		Values [][]interface{} `json:"values"`
+	}
+	if err := json.Unmarshal(body, &devstatus); err != nil {
+		return nil, err
+	}
+
+	levels := map[string]float64{}
+	table := devstatus["pcu"]
+	serialColumn, levelColumn := -1, -1
+	for i, field := range table.Fields {
+		switch field {
+		case "serialNumber":
+			serialColumn = i
+		case "commLevel", "pcuCommLevel", "commLevel24g":
+			if levelColumn == -1 {
+				levelColumn = i
+			}
+		}
+	}
+	if serialColumn == -1 || levelColumn == -1 {
+		return levels, nil
+	}
+	for _, row := range table.Values {
+		if len(row) <= serialColumn || len(row) <= levelColumn {
+			continue
+		}
+		serial := fmt.Sprint(row[serialColumn])
+		if level, ok := row[levelColumn].(float64); ok {
+			levels[serial] = level
+		}
+	}
+	return levels, nil
+}
+
+// loadInverterDetails polls the detailed microinverter data, the
+// communication levels are only added when the firmware reports them
+func loadInverterDetails(envoy *envoyClient) int {
+	body, err := envoy.getBody("/ivp/pdm/device_data", "device_data")
+	if err != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error loading inverter device data"}).Warn(err)
+		return 0
+	}
+	devices, err := decodeDeviceData(body)
+	if err != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error decoding inverter device data"}).Warn(err)
+		return 0
+	}
+
+	commLevels, err := loadCommLevels(envoy)
+	if err != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error loading inverter comm levels"}).Debug(err)
+	}
+	return writeInverterDetails(envoy, devices, commLevels, 0)
+}
+
+// writeInverterDetails writes the DC and AC side of every microinverter to
+// inverter_details, tagged with its full serial, at the end of its last
+// reporting interval
+func writeInverterDetails(envoy *envoyClient, devices []pdmDevice, commLevels map[string]float64, shift time.Duration) int {
+	writeErrors := 0
+	for _, device := range devices {
+		if device.DevName != "pcu" {
+			continue
+		}
+		for _, channel := range device.Channels {
+			reading := channel.LastReading
+			fields := map[string]interface{}{
+				"wattsNow":         channel.Watts.Now,
+				"wattsMax":         channel.Watts.Max,
+				"whLifetime":       channel.Lifetime.JoulesProduced / 3600,
+				"acVoltage":        reading.AcVoltageINmV / 1000,
+				"acFrequency":      reading.AcFrequencyINmHz / 1000,
+				"dcVoltage":        reading.DcVoltageINmV / 1000,
+				"dcCurrent":        reading.DcCurrentINmA / 1000,
+				"temperature":      reading.ChannelTemp,
+				"convErrorSeconds": reading.PwrConvErrSecs,
+				"active":           device.Active,
+			}
+			if level, ok := commLevels[device.SN]; ok {
+				fields["commLevel"] = level
+			}
+
+			eventTime := time.Unix(reading.EndDate, 0).Add(shift)
+			if reading.EndDate == 0 {
+				eventTime = time.Now()
+			}
+			tags := map[string]string{"serial": envoy.serial, "site": envoy.name, "inverter": device.SN}
+			if writeToInfluxDB(influxDBcnx, "inverter_details", tags, fields, eventTime) != nil {
+				writeErrors++
+			}
+		}
+	}
+	return writeErrors
+}
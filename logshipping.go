@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+// shippedEntry is a copy of a log entry taken when the hook fires, logrus
+// reuses entries so they can't be kept around until the batch is sent
+type shippedEntry struct {
+	Time    time.Time
+	Level   log.Level
+	Message string
+	Data    log.Fields
+}
+
+// shippingHook batches log entries in memory and hands them to send from a
+// background goroutine. Entries are dropped rather than blocking the collector
+// when the remote end can't keep up.
+type shippingHook struct {
+	name          string
+	send          func(entries []shippedEntry) error
+	queue         chan shippedEntry
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	flushed       chan chan struct{}
+	dropped       int
+	droppedMutex  sync.Mutex
+}
+
+// newShippingHook takes a batchSize or flushIntervalSeconds below 1 as 1,
+// the queue would have no room and the ticker can't tick every 0s
+func newShippingHook(name string, send func(entries []shippedEntry) error) *shippingHook {
+	batchSize := config.Int("logShipping.batchSize", 100)
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	flushIntervalSeconds := config.Int("logShipping.flushIntervalSeconds", 5)
+	if flushIntervalSeconds < 1 {
+		flushIntervalSeconds = 1
+	}
+
+	hook := &shippingHook{
+		name:          name,
+		send:          send,
+		queue:         make(chan shippedEntry, batchSize*10),
+		batchSize:     batchSize,
+		flushInterval: time.Duration(flushIntervalSeconds) * time.Second,
+		maxRetries:    config.Int("logShipping.maxRetries", 3),
+		flushed:       make(chan chan struct{}),
+	}
+	go hook.run()
+
+	return hook
+}
+
+// Levels ships logShipping.level and the levels above it, a level out of
+// range is taken as the nearest valid one
+func (hook *shippingHook) Levels() []log.Level {
+	level := config.Int("logShipping.level", int(log.InfoLevel))
+	if level < 0 {
+		level = 0
+	}
+	if level > len(log.AllLevels)-1 {
+		level = len(log.AllLevels) - 1
+	}
+	return log.AllLevels[:level+1]
+}
+
+func (hook *shippingHook) Fire(entry *log.Entry) error {
+	data := make(log.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		data[key] = value
+	}
+
+	select {
+	case hook.queue <- shippedEntry{Time: entry.Time, Level: entry.Level, Message: entry.Message, Data: data}:
+	default:
+		hook.droppedMutex.Lock()
+		hook.dropped++
+		hook.droppedMutex.Unlock()
+	}
+
+	return nil
+}
+
+// Flush blocks until everything queued so far has been sent or given up on
+func (hook *shippingHook) Flush() {
+	done := make(chan struct{})
+	hook.flushed <- done
+	<-done
+}
+
+func (hook *shippingHook) run() {
+	ticker := time.NewTicker(hook.flushInterval)
+	batch := make([]shippedEntry, 0, hook.batchSize)
+
+	for {
+		select {
+		case entry := <-hook.queue:
+			batch = append(batch, entry)
+			if len(batch) >= hook.batchSize {
+				hook.sendWithRetry(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				hook.sendWithRetry(batch)
+				batch = batch[:0]
+			}
+		case done := <-hook.flushed:
+			for len(hook.queue) > 0 {
+				batch = append(batch, <-hook.queue)
+			}
+			if len(batch) > 0 {
+				hook.sendWithRetry(batch)
+				batch = batch[:0]
+			}
+			close(done)
+		}
+	}
+}
+
+// sendWithRetry can't log through logrus, that would feed the hook itself, so
+// failures are reported on stderr
+func (hook *shippingHook) sendWithRetry(batch []shippedEntry) {
+	backoff := time.Second
+
+	for attempt := 0; ; attempt++ {
+		err := hook.send(batch)
+		if err == nil {
+			break
+		}
+		if attempt >= hook.maxRetries {
+			fmt.Fprintf(os.Stderr, "%s: giving up on %d log entries: %s\n", hook.name, len(batch), err)
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	hook.droppedMutex.Lock()
+	if hook.dropped > 0 {
+		fmt.Fprintf(os.Stderr, "%s: dropped %d log entries, queue full\n", hook.name, hook.dropped)
+		hook.dropped = 0
+	}
+	hook.droppedMutex.Unlock()
+}
+
+// shippingHTTPClient builds the client for a log sink from its
+// <prefix>.caFile and <prefix>.insecureSkipVerify settings
+func shippingHTTPClient(prefix string) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.Bool(prefix + ".insecureSkipVerify")}
+
+	if caFile := config.String(prefix + ".caFile"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+func postJSON(client *http.Client, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, res.Status)
+	}
+	return nil
+}
+
+// entryEvent flattens an entry into the JSON object shipped to Splunk and Loki
+func entryEvent(entry shippedEntry) map[string]interface{} {
+	event := make(map[string]interface{}, len(entry.Data)+2)
+	for key, value := range entry.Data {
+		event[key] = value
+	}
+	event["message"] = entry.Message
+	event["level"] = entry.Level.String()
+	return event
+}
+
+// newSplunkHECSender posts batches to a Splunk HTTP Event Collector
+// (https://splunk:8088/services/collector/event)
+func newSplunkHECSender() (func(entries []shippedEntry) error, error) {
+	client, err := shippingHTTPClient("splunk")
+	if err != nil {
+		return nil, err
+	}
+	url := config.String("splunk.url")
+	headers := map[string]string{"Authorization": "Splunk " + secret("splunk.token")}
+	host, _ := os.Hostname()
+
+	return func(entries []shippedEntry) error {
+		var body bytes.Buffer
+		encoder := json.NewEncoder(&body)
+
+		// HEC accepts several events simply concatenated in one request
+		for _, entry := range entries {
+			hecEvent := map[string]interface{}{
+				"time":       float64(entry.Time.UnixNano()) / 1e9,
+				"host":       host,
+				"source":     config.String("splunk.source", "enphaselocal2influx"),
+				"sourcetype": config.String("splunk.sourcetype", "_json"),
+				"event":      entryEvent(entry),
+			}
+			if index := config.String("splunk.index"); index != "" {
+				hecEvent["index"] = index
+			}
+			if err := encoder.Encode(hecEvent); err != nil {
+				return err
+			}
+		}
+
+		return postJSON(client, url, body.Bytes(), headers)
+	}, nil
+}
+
+// newLokiSender posts batches to the Loki push API
+// (http://loki:3100/loki/api/v1/push), one stream per log level
+func newLokiSender() (func(entries []shippedEntry) error, error) {
+	client, err := shippingHTTPClient("loki")
+	if err != nil {
+		return nil, err
+	}
+	url := config.String("loki.url")
+	labels := config.StringMap("loki.labels")
+	if len(labels) == 0 {
+		labels = map[string]string{"job": "enphaselocal2influx"}
+	}
+	headers := map[string]string{}
+	if tenant := config.String("loki.tenantID"); tenant != "" {
+		headers["X-Scope-OrgID"] = tenant
+	}
+	if user := config.String("loki.username"); user != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+secret("loki.password")))
+	}
+
+	return func(entries []shippedEntry) error {
+		streams := map[string][][2]string{}
+		for _, entry := range entries {
+			line, err := json.Marshal(entryEvent(entry))
+			if err != nil {
+				return err
+			}
+			level := entry.Level.String()
+			streams[level] = append(streams[level], [2]string{strconv.FormatInt(entry.Time.UnixNano(), 10), string(line)})
+		}
+
+		levels := make([]string, 0, len(streams))
+		for level := range streams {
+			levels = append(levels, level)
+		}
+		sort.Strings(levels)
+
+		push := struct {
+			Streams []map[string]interface{} `json:"streams"`
+		}{}
+		for _, level := range levels {
+			streamLabels := map[string]string{"level": level}
+			for key, value := range labels {
+				streamLabels[key] = value
+			}
+			push.Streams = append(push.Streams, map[string]interface{}{"stream": streamLabels, "values": streams[level]})
+		}
+
+		body, err := json.Marshal(push)
+		if err != nil {
+			return err
+		}
+
+		return postJSON(client, url, body, headers)
+	}, nil
+}
+
+// initLogShipping adds the Splunk HEC and Loki hooks that are enabled in
+// config. It must run after the redaction hook has been added.
+func initLogShipping() {
+	var hooks []*shippingHook
+
+	if config.Bool("splunk.enabled") {
+		send, err := newSplunkHECSender()
+		if err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Error setting up Splunk HEC log shipping"}).Error(err)
+		} else {
+			hooks = append(hooks, newShippingHook("splunk", send))
+		}
+	}
+
+	if config.Bool("loki.enabled") {
+		send, err := newLokiSender()
+		if err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Error setting up Loki log shipping"}).Error(err)
+		} else {
+			hooks = append(hooks, newShippingHook("loki", send))
+		}
+	}
+
+	for _, hook := range hooks {
+		log.AddHook(hook)
+		// Fatal logs exit the process, make sure what led to it gets out
+		log.RegisterExitHandler(hook.Flush)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+func TestShippingHookClampsSettings(t *testing.T) {
+	setupTest(t)
+	config.Set("logShipping.batchSize", 0)
+	config.Set("logShipping.flushIntervalSeconds", 0)
+	config.Set("logShipping.level", 42)
+
+	shipped := make(chan []shippedEntry, 1)
+	hook := newShippingHook("test", func(entries []shippedEntry) error {
+		shipped <- append([]shippedEntry(nil), entries...)
+		return nil
+	})
+	if hook.batchSize != 1 || hook.flushInterval != time.Second {
+		t.Fatalf("batch size %d, flush interval %s", hook.batchSize, hook.flushInterval)
+	}
+	if levels := hook.Levels(); len(levels) != len(log.AllLevels) {
+		t.Errorf("ships %v", levels)
+	}
+
+	hook.Fire(&log.Entry{Time: time.Now(), Level: log.InfoLevel, Message: "Poll done", Data: log.Fields{}})
+	select {
+	case entries := <-shipped:
+		if len(entries) != 1 || entries[0].Message != "Poll done" {
+			t.Errorf("shipped %+v", entries)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing shipped")
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
@@ -28,6 +29,24 @@ import (
 
 const configFilePath = "config.yaml"
 
+// httpTimeout bounds every outgoing call so a hung request can't stall
+// polling, tests shorten it
+var httpTimeout = 30 * time.Second
+
+// Base URLs of the services the collector talks to. They can be overridden in
+// config, e.g. to point at a local stand-in when developing.
+func enlightenURL() string {
+	return strings.TrimSuffix(config.String("enphase.EnlightenURL", "https://enlighten.enphaseenergy.com"), "/")
+}
+
+func entrezURL() string {
+	return strings.TrimSuffix(config.String("enphase.EntrezURL", "https://entrez.enphaseenergy.com"), "/")
+}
+
+func senseURL() string {
+	return strings.TrimSuffix(config.String("sense.apiURL", "https://api.sense.com"), "/")
+}
+
 type JWTToken struct {
 	Token          string `json:"token"`
 	ExpiresAt      int    `json:"expires_at"`
@@ -119,6 +138,19 @@ type Consumption struct {
 // 	State       string `json:"state"`
 // }
 
+// SenseDevice is one device detected by Sense, with its share of the trends
+// period. Tags differ from device to device, only UserDeviceTypeDisplayString
+// is used.
+type SenseDevice struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	Avgw      float64                `json:"avgw"`
+	TotalKwh  float64                `json:"total_kwh"`
+	TotalCost float64                `json:"total_cost"`
+	Pct       float64                `json:"pct"`
+	Tags      map[string]interface{} `json:"tags"`
+}
+
 type SenseTrends struct {
 	// Steps       int       `json:"steps"`
 	// Start       time.Time `json:"start"`
@@ -126,288 +158,15 @@ type SenseTrends struct {
 	Consumption struct {
 		Total float64 `json:"total"`
 		// 	Totals  []float64 `json:"totals"`
-		// 	Devices []struct {
-		// 		ID   string `json:"id"`
-		// 		Name string `json:"name"`
-		// 		Icon string `json:"icon"`
-		// 		Tags struct {
-		// 			DefaultUserDeviceType       string `json:"DefaultUserDeviceType"`
-		// 			DeviceListAllowed           string `json:"DeviceListAllowed"`
-		// 			TimelineAllowed             string `json:"TimelineAllowed"`
-		// 			UserDeleted                 string `json:"UserDeleted"`
-		// 			UserDeviceTypeDisplayString string `json:"UserDeviceTypeDisplayString"`
-		// 			UserEditable                string `json:"UserEditable"`
-		// 			UserMergeable               string `json:"UserMergeable"`
-		// 			UserShowBubble              string `json:"UserShowBubble"`
-		// 			UserShowInDeviceList        string `json:"UserShowInDeviceList"`
-		// 		} `json:"tags,omitempty"`
-		// 		History     []float64 `json:"history"`
-		// 		Avgw        float64   `json:"avgw"`
-		// 		TotalKwh    float64   `json:"total_kwh"`
-		// 		TotalCost   int       `json:"total_cost"`
-		// 		Pct         float64   `json:"pct"`
-		// 		CostHistory []int     `json:"cost_history"`
-		// 		Tags0       struct {
-		// 			Alertable             string    `json:"Alertable"`
-		// 			AlwaysOn              string    `json:"AlwaysOn"`
-		// 			DateCreated           time.Time `json:"DateCreated"`
-		// 			DateFirstUsage        string    `json:"DateFirstUsage"`
-		// 			DefaultUserDeviceType string    `json:"DefaultUserDeviceType"`
-		// 			DeployToMonitor       string    `json:"DeployToMonitor"`
-		// 			DeviceListAllowed     string    `json:"DeviceListAllowed"`
-		// 			ModelCreatedVersion   string    `json:"ModelCreatedVersion"`
-		// 			ModelUpdatedVersion   string    `json:"ModelUpdatedVersion"`
-		// 			NameUseredit          string    `json:"name_useredit"`
-		// 			OriginalName          string    `json:"OriginalName"`
-		// 			PeerNames             []struct {
-		// 				Name                        string  `json:"Name"`
-		// 				UserDeviceType              string  `json:"UserDeviceType"`
-		// 				Percent                     float64 `json:"Percent"`
-		// 				Icon                        string  `json:"Icon"`
-		// 				UserDeviceTypeDisplayString string  `json:"UserDeviceTypeDisplayString"`
-		// 			} `json:"PeerNames"`
-		// 			Pending                     string `json:"Pending"`
-		// 			Revoked                     string `json:"Revoked"`
-		// 			TimelineAllowed             string `json:"TimelineAllowed"`
-		// 			TimelineDefault             string `json:"TimelineDefault"`
-		// 			Type                        string `json:"Type"`
-		// 			UserDeletable               string `json:"UserDeletable"`
-		// 			UserDeviceTypeDisplayString string `json:"UserDeviceTypeDisplayString"`
-		// 			UserEditable                string `json:"UserEditable"`
-		// 			UserEditableMeta            string `json:"UserEditableMeta"`
-		// 			UserMergeable               string `json:"UserMergeable"`
-		// 			UserShowBubble              string `json:"UserShowBubble"`
-		// 			UserShowInDeviceList        string `json:"UserShowInDeviceList"`
-		// 		} `json:"tags,omitempty"`
-		// 		Tags1 struct {
-		// 			Alertable             string    `json:"Alertable"`
-		// 			AlwaysOn              string    `json:"AlwaysOn"`
-		// 			DateCreated           time.Time `json:"DateCreated"`
-		// 			DateFirstUsage        string    `json:"DateFirstUsage"`
-		// 			DefaultUserDeviceType string    `json:"DefaultUserDeviceType"`
-		// 			DeployToMonitor       string    `json:"DeployToMonitor"`
-		// 			DeviceListAllowed     string    `json:"DeviceListAllowed"`
-		// 			ModelCreatedVersion   string    `json:"ModelCreatedVersion"`
-		// 			ModelUpdatedVersion   string    `json:"ModelUpdatedVersion"`
-		// 			NameUseredit          string    `json:"name_useredit"`
-		// 			OriginalName          string    `json:"OriginalName"`
-		// 			PeerNames             []struct {
-		// 				Name                        string  `json:"Name"`
-		// 				UserDeviceType              string  `json:"UserDeviceType"`
-		// 				Percent                     float64 `json:"Percent"`
-		// 				Icon                        string  `json:"Icon"`
-		// 				UserDeviceTypeDisplayString string  `json:"UserDeviceTypeDisplayString"`
-		// 			} `json:"PeerNames"`
-		// 			Pending                     string `json:"Pending"`
-		// 			Revoked                     string `json:"Revoked"`
-		// 			TimelineAllowed             string `json:"TimelineAllowed"`
-		// 			TimelineDefault             string `json:"TimelineDefault"`
-		// 			Type                        string `json:"Type"`
-		// 			UserDeletable               string `json:"UserDeletable"`
-		// 			UserDeviceTypeDisplayString string `json:"UserDeviceTypeDisplayString"`
-		// 			UserEditable                string `json:"UserEditable"`
-		// 			UserEditableMeta            string `json:"UserEditableMeta"`
-		// 			UserMergeable               string `json:"UserMergeable"`
-		// 			UserShowBubble              string `json:"UserShowBubble"`
-		// 			UserShowInDeviceList        string `json:"UserShowInDeviceList"`
-		// 		} `json:"tags,omitempty"`
-		// 		Tags2 struct {
-		// 			Alertable             string    `json:"Alertable"`
-		// 			AlwaysOn              string    `json:"AlwaysOn"`
-		// 			DateCreated           time.Time `json:"DateCreated"`
-		// 			DateFirstUsage        string    `json:"DateFirstUsage"`
-		// 			DefaultUserDeviceType string    `json:"DefaultUserDeviceType"`
-		// 			DeployToMonitor       string    `json:"DeployToMonitor"`
-		// 			DeviceListAllowed     string    `json:"DeviceListAllowed"`
-		// 			ModelCreatedVersion   string    `json:"ModelCreatedVersion"`
-		// 			ModelUpdatedVersion   string    `json:"ModelUpdatedVersion"`
-		// 			NameUseredit          string    `json:"name_useredit"`
-		// 			OriginalName          string    `json:"OriginalName"`
-		// 			PeerNames             []struct {
-		// 				Name                        string  `json:"Name"`
-		// 				UserDeviceType              string  `json:"UserDeviceType"`
-		// 				Percent                     float64 `json:"Percent"`
-		// 				Icon                        string  `json:"Icon"`
-		// 				UserDeviceTypeDisplayString string  `json:"UserDeviceTypeDisplayString"`
-		// 			} `json:"PeerNames"`
-		// 			Pending                     string `json:"Pending"`
-		// 			Revoked                     string `json:"Revoked"`
-		// 			TimelineAllowed             string `json:"TimelineAllowed"`
-		// 			TimelineDefault             string `json:"TimelineDefault"`
-		// 			Type                        string `json:"Type"`
-		// 			UserDeletable               string `json:"UserDeletable"`
-		// 			UserDeviceTypeDisplayString string `json:"UserDeviceTypeDisplayString"`
-		// 			UserEditable                string `json:"UserEditable"`
-		// 			UserEditableMeta            string `json:"UserEditableMeta"`
-		// 			UserMergeable               string `json:"UserMergeable"`
-		// 			UserShowBubble              string `json:"UserShowBubble"`
-		// 			UserShowInDeviceList        string `json:"UserShowInDeviceList"`
-		// 		} `json:"tags,omitempty"`
-		// 		Tags3 struct {
-		// 			Alertable             string    `json:"Alertable"`
-		// 			AlwaysOn              string    `json:"AlwaysOn"`
-		// 			DateCreated           time.Time `json:"DateCreated"`
-		// 			DateFirstUsage        string    `json:"DateFirstUsage"`
-		// 			DefaultUserDeviceType string    `json:"DefaultUserDeviceType"`
-		// 			DeployToMonitor       string    `json:"DeployToMonitor"`
-		// 			DeviceListAllowed     string    `json:"DeviceListAllowed"`
-		// 			ModelCreatedVersion   string    `json:"ModelCreatedVersion"`
-		// 			ModelUpdatedVersion   string    `json:"ModelUpdatedVersion"`
-		// 			NameUseredit          string    `json:"name_useredit"`
-		// 			NameUserGuess         string    `json:"NameUserGuess"`
-		// 			OriginalName          string    `json:"OriginalName"`
-		// 			PeerNames             []struct {
-		// 				Name                        string  `json:"Name"`
-		// 				UserDeviceType              string  `json:"UserDeviceType"`
-		// 				Percent                     float64 `json:"Percent"`
-		// 				Icon                        string  `json:"Icon"`
-		// 				UserDeviceTypeDisplayString string  `json:"UserDeviceTypeDisplayString"`
-		// 			} `json:"PeerNames"`
-		// 			Pending                     string `json:"Pending"`
-		// 			PreselectionIndex           int    `json:"PreselectionIndex"`
-		// 			Revoked                     string `json:"Revoked"`
-		// 			TimelineAllowed             string `json:"TimelineAllowed"`
-		// 			TimelineDefault             string `json:"TimelineDefault"`
-		// 			Type                        string `json:"Type"`
-		// 			UserDeletable               string `json:"UserDeletable"`
-		// 			UserDeviceType              string `json:"UserDeviceType"`
-		// 			UserDeviceTypeDisplayString string `json:"UserDeviceTypeDisplayString"`
-		// 			UserEditable                string `json:"UserEditable"`
-		// 			UserEditableMeta            string `json:"UserEditableMeta"`
-		// 			UserMergeable               string `json:"UserMergeable"`
-		// 			UserShowBubble              string `json:"UserShowBubble"`
-		// 			UserShowInDeviceList        string `json:"UserShowInDeviceList"`
-		// 		} `json:"tags,omitempty"`
-		// 		Tags4 struct {
-		// 			Alertable             string    `json:"Alertable"`
-		// 			AlwaysOn              string    `json:"AlwaysOn"`
-		// 			DateCreated           time.Time `json:"DateCreated"`
-		// 			DateFirstUsage        string    `json:"DateFirstUsage"`
-		// 			DefaultUserDeviceType string    `json:"DefaultUserDeviceType"`
-		// 			DeployToMonitor       string    `json:"DeployToMonitor"`
-		// 			DeviceListAllowed     string    `json:"DeviceListAllowed"`
-		// 			ModelCreatedVersion   string    `json:"ModelCreatedVersion"`
-		// 			ModelUpdatedVersion   string    `json:"ModelUpdatedVersion"`
-		// 			NameUseredit          string    `json:"name_useredit"`
-		// 			NameUserGuess         string    `json:"NameUserGuess"`
-		// 			OriginalName          string    `json:"OriginalName"`
-		// 			PeerNames             []struct {
-		// 				Name                        string  `json:"Name"`
-		// 				UserDeviceType              string  `json:"UserDeviceType"`
-		// 				Percent                     float64 `json:"Percent"`
-		// 				Icon                        string  `json:"Icon"`
-		// 				UserDeviceTypeDisplayString string  `json:"UserDeviceTypeDisplayString"`
-		// 			} `json:"PeerNames"`
-		// 			Pending                     string `json:"Pending"`
-		// 			Revoked                     string `json:"Revoked"`
-		// 			TimelineAllowed             string `json:"TimelineAllowed"`
-		// 			TimelineDefault             string `json:"TimelineDefault"`
-		// 			Type                        string `json:"Type"`
-		// 			UserDeletable               string `json:"UserDeletable"`
-		// 			UserDeviceType              string `json:"UserDeviceType"`
-		// 			UserDeviceTypeDisplayString string `json:"UserDeviceTypeDisplayString"`
-		// 			UserEditable                string `json:"UserEditable"`
-		// 			UserEditableMeta            string `json:"UserEditableMeta"`
-		// 			UserMergeable               string `json:"UserMergeable"`
-		// 			UserShowBubble              string `json:"UserShowBubble"`
-		// 			UserShowInDeviceList        string `json:"UserShowInDeviceList"`
-		// 		} `json:"tags,omitempty"`
-		// 		Tags5 struct {
-		// 			Alertable             string    `json:"Alertable"`
-		// 			AlwaysOn              string    `json:"AlwaysOn"`
-		// 			DateCreated           time.Time `json:"DateCreated"`
-		// 			DateFirstUsage        string    `json:"DateFirstUsage"`
-		// 			DefaultUserDeviceType string    `json:"DefaultUserDeviceType"`
-		// 			DeployToMonitor       string    `json:"DeployToMonitor"`
-		// 			DeviceListAllowed     string    `json:"DeviceListAllowed"`
-		// 			ModelCreatedVersion   string    `json:"ModelCreatedVersion"`
-		// 			ModelUpdatedVersion   string    `json:"ModelUpdatedVersion"`
-		// 			NameUseredit          string    `json:"name_useredit"`
-		// 			OriginalName          string    `json:"OriginalName"`
-		// 			PeerNames             []struct {
-		// 				Name                        string  `json:"Name"`
-		// 				UserDeviceType              string  `json:"UserDeviceType"`
-		// 				Percent                     float64 `json:"Percent"`
-		// 				Icon                        string  `json:"Icon"`
-		// 				UserDeviceTypeDisplayString string  `json:"UserDeviceTypeDisplayString"`
-		// 			} `json:"PeerNames"`
-		// 			Pending                     string `json:"Pending"`
-		// 			Revoked                     string `json:"Revoked"`
-		// 			TimelineAllowed             string `json:"TimelineAllowed"`
-		// 			TimelineDefault             string `json:"TimelineDefault"`
-		// 			Type                        string `json:"Type"`
-		// 			UserDeletable               string `json:"UserDeletable"`
-		// 			UserDeviceTypeDisplayString string `json:"UserDeviceTypeDisplayString"`
-		// 			UserEditable                string `json:"UserEditable"`
-		// 			UserEditableMeta            string `json:"UserEditableMeta"`
-		// 			UserMergeable               string `json:"UserMergeable"`
-		// 			UserShowBubble              string `json:"UserShowBubble"`
-		// 			UserShowInDeviceList        string `json:"UserShowInDeviceList"`
-		// 		} `json:"tags,omitempty"`
-		// 		Make  string `json:"make,omitempty"`
-		// 		Tags6 struct {
-		// 			Alertable                   string        `json:"Alertable"`
-		// 			AlwaysOn                    string        `json:"AlwaysOn"`
-		// 			DateCreated                 time.Time     `json:"DateCreated"`
-		// 			DateFirstUsage              string        `json:"DateFirstUsage"`
-		// 			DefaultUserDeviceType       string        `json:"DefaultUserDeviceType"`
-		// 			DeployToMonitor             string        `json:"DeployToMonitor"`
-		// 			DeviceListAllowed           string        `json:"DeviceListAllowed"`
-		// 			MergedDevices               string        `json:"MergedDevices"`
-		// 			ModelCreatedVersion         string        `json:"ModelCreatedVersion"`
-		// 			ModelUpdatedVersion         string        `json:"ModelUpdatedVersion"`
-		// 			NameUseredit                string        `json:"name_useredit"`
-		// 			OriginalName                string        `json:"OriginalName"`
-		// 			PeerNames                   []interface{} `json:"PeerNames"`
-		// 			Pending                     string        `json:"Pending"`
-		// 			Revoked                     string        `json:"Revoked"`
-		// 			TimelineAllowed             string        `json:"TimelineAllowed"`
-		// 			TimelineDefault             string        `json:"TimelineDefault"`
-		// 			Type                        string        `json:"Type"`
-		// 			UserDeletable               string        `json:"UserDeletable"`
-		// 			UserDeviceType              string        `json:"UserDeviceType"`
-		// 			UserDeviceTypeDisplayString string        `json:"UserDeviceTypeDisplayString"`
-		// 			UserEditable                string        `json:"UserEditable"`
-		// 			UserEditableMeta            string        `json:"UserEditableMeta"`
-		// 			UserMergeable               string        `json:"UserMergeable"`
-		// 			UserShowBubble              string        `json:"UserShowBubble"`
-		// 			UserShowInDeviceList        string        `json:"UserShowInDeviceList"`
-		// 			Virtual                     string        `json:"Virtual"`
-		// 		} `json:"tags,omitempty"`
-		// 		GivenMake string `json:"given_make,omitempty"`
-		// 		MonitorID int    `json:"monitorId,omitempty"`
-		// 		Tags7     struct {
-		// 			UserDeviceTypeDisplayString string `json:"UserDeviceTypeDisplayString"`
-		// 		} `json:"tags,omitempty"`
-		// 	} `json:"devices"`
-		TotalCost int `json:"total_cost"`
+		Devices   []SenseDevice `json:"devices"`
+		TotalCost int           `json:"total_cost"`
 		// 	TotalCosts []int `json:"total_costs"`
 	} `json:"consumption"`
 	Production struct {
 		Total float64 `json:"total"`
 		// 	Totals  []float64 `json:"totals"`
-		// 	Devices []struct {
-		// 		ID   string `json:"id"`
-		// 		Name string `json:"name"`
-		// 		Icon string `json:"icon"`
-		// 		Tags struct {
-		// 			DefaultUserDeviceType       string `json:"DefaultUserDeviceType"`
-		// 			DeviceListAllowed           string `json:"DeviceListAllowed"`
-		// 			TimelineAllowed             string `json:"TimelineAllowed"`
-		// 			UserDeleted                 string `json:"UserDeleted"`
-		// 			UserDeviceTypeDisplayString string `json:"UserDeviceTypeDisplayString"`
-		// 			UserEditable                string `json:"UserEditable"`
-		// 			UserMergeable               string `json:"UserMergeable"`
-		// 			UserShowBubble              string `json:"UserShowBubble"`
-		// 			UserShowInDeviceList        string `json:"UserShowInDeviceList"`
-		// 		} `json:"tags"`
-		// 		History     []float64 `json:"history"`
-		// 		Avgw        float64   `json:"avgw"`
-		// 		TotalCost   int       `json:"total_cost"`
-		// 		Pct         float64   `json:"pct"`
-		// 		CostHistory []int     `json:"cost_history"`
-		// 	} `json:"devices"`
-		TotalCost int `json:"total_cost"`
+		Devices   []SenseDevice `json:"devices"`
+		TotalCost int           `json:"total_cost"`
 		// 	TotalCosts []int `json:"total_costs"`
 	} `json:"production"`
 	// GridToBattery              interface{} `json:"grid_to_battery"`
@@ -442,12 +201,12 @@ type SenseAuth struct {
 }
 
 func authSense() string {
-	authURL := "https://api.sense.com/apiservice/api/v1/authenticate"
+	authURL := senseURL() + "/apiservice/api/v1/authenticate"
 	method := "POST"
 
-	payload := strings.NewReader("email=" + url.QueryEscape(config.String("sense.username")) + "&password=" + url.QueryEscape(config.String("sense.password")))
+	payload := strings.NewReader("email=" + url.QueryEscape(config.String("sense.username")) + "&password=" + url.QueryEscape(secret("sense.password")))
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: httpTimeout}
 	req, err := http.NewRequest(method, authURL, payload)
 
 	if err != nil {
@@ -479,11 +238,12 @@ func authSense() string {
 		splunkLogger.WithFields(log.Fields{"Error": "Error getting response body in HTTP call to Sense API"}).Error(err)
 		return ""
 	}
+	registerSecret(authResponse.AccessToken)
 	return authResponse.AccessToken
 }
 
 func writeToInfluxDB(c influxclient.Client, pointName string, tags map[string]string,
-	fields map[string]interface{}, t time.Time) {
+	fields map[string]interface{}, t time.Time) error {
 
 	bp, nBPError := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{
 		Database: config.String("influxdb.db"),
@@ -491,12 +251,16 @@ func writeToInfluxDB(c influxclient.Client, pointName string, tags map[string]st
 
 	if nBPError != nil {
 		splunkLogger.WithFields(log.Fields{"Error": "Error creating Batchpoints with config"}).Error(nBPError)
-
+		return nBPError
 	}
 
 	// 	fmt.Println(bp)
 
-	p, _ := influxclient.NewPoint(pointName, tags, fields, t)
+	fields = selectFields(pointName, conformFields(pointName, fields))
+	if len(fields) == 0 {
+		return nil
+	}
+	p, _ := influxclient.NewPoint(measurementName(pointName), withStaticTags(tags), fields, t)
 
 	bp.AddPoint(p)
 
@@ -505,11 +269,13 @@ func writeToInfluxDB(c influxclient.Client, pointName string, tags map[string]st
 		splunkLogger.WithFields(log.Fields{"Error": "Expected to see no error and didn't"}).Error(writeErr)
 
 	} else {
+		recordInfluxWrite()
 		// log.Debugf("Wrote %v into InfluxDB with tags %v and value: %v at %v\n", pointName, tags, fields, t)
 		splunkLogger.WithFields(fields).WithField("point", pointName).WithField("fields", fmt.Sprint(fields)).WithField("tags", fmt.Sprint(tags)).Debug("Wrote point into InfluxDB")
 
 	}
 
+	return writeErr
 }
 
 func setupConfig() {
@@ -525,77 +291,81 @@ func setupConfig() {
 }
 
 // 6 months token: https://enlighten.enphaseenergy.com/entrez-auth-token?serial_num=SERIALNUMBER
-func getLongLivedJWT() (JWTToken, error) {
+func getLongLivedJWT(envoy *envoyClient) (JWTToken, error) {
+
+	envoy.logger.Info("Getting long lived JWT token")
 
-	splunkLogger.Info("Getting long lived JWT token")
+	jwtToken := JWTToken{}
 
 	jar, _ := cookiejar.New(nil)
 	client := &http.Client{
-		Jar: jar,
+		Jar:     jar,
+		Timeout: httpTimeout,
 	}
 
 	// First, login using your username and password
-	fieldsLogin := url.Values{"user[email]": {config.String("enphase.EnphaseUser")}, "user[password]": {config.String("enphase.EnphasePassword")}}
+	fieldsLogin := url.Values{"user[email]": {envoy.setting("EnphaseUser")}, "user[password]": {envoy.secret("EnphasePassword")}}
 
-	_, errLogin := client.PostForm("https://enlighten.enphaseenergy.com//login/login", fieldsLogin)
+	_, errLogin := client.PostForm(enlightenURL()+"/login/login", fieldsLogin)
 
 	if errLogin != nil {
-		splunkLogger.WithField("Error", errLogin).Fatalf("Error loggin in to get long term JWT")
-
+		envoy.logger.WithField("Error", errLogin).Errorln("Error loggin in to get long term JWT")
+		return jwtToken, errLogin
 	}
 
-	req, _ := http.NewRequest("GET", fmt.Sprintf("https://enlighten.enphaseenergy.com/entrez-auth-token?serial_num=%s", config.String("enphase.EnphaseEnvoySerial")), nil)
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/entrez-auth-token?serial_num=%s", enlightenURL(), envoy.serial), nil)
 	requestResponse, requestError := client.Do(req)
 	if requestError != nil {
-		splunkLogger.WithFields(log.Fields{"Error": "Issue loging-in getting long term JWT", "Enphase Serial": config.String("enphase.EnphaseEnvoySerial")}).Error(requestError)
-		panic(0)
-
+		envoy.logger.WithFields(log.Fields{"Error": "Issue loging-in getting long term JWT"}).Error(requestError)
+		return jwtToken, requestError
 	}
-	splunkLogger.WithField("response", requestResponse).WithField("EnphaseSerial", config.String("enphase.EnphaseEnvoySerial")).Debugln("Response from Enphase entrez-auth-token")
+	envoy.logger.WithField("response", requestResponse).Debugln("Response from Enphase entrez-auth-token")
 
 	defer requestResponse.Body.Close()
 
 	body, err := io.ReadAll(requestResponse.Body)
 	if err != nil {
-		splunkLogger.WithField("Error", err).Fatalln("Error reading response body:" + requestResponse.Status)
-
+		envoy.logger.WithField("Error", err).Errorln("Error reading response body:" + requestResponse.Status)
+		return jwtToken, err
 	}
 
-	jwtToken := JWTToken{}
 	unmarshalError := json.Unmarshal([]byte(body), &jwtToken)
 
-	if unmarshalError != nil {
-		splunkLogger.WithFields(log.Fields{"responseBody": string(body), "unmarshalError": unmarshalError}).Fatalln("Error unmarshalling Enlighten data")
+	if unmarshalError != nil || jwtToken.Token == "" {
+		envoy.logger.WithFields(log.Fields{"responseBody": string(body), "unmarshalError": unmarshalError, "responseStatusCode": requestResponse.StatusCode}).Errorln("Error unmarshalling Enlighten data")
+		return jwtToken, fmt.Errorf("no token in Enlighten response: %s", requestResponse.Status)
 	}
-	splunkLogger.Infoln("Retrieved long-lived JWT token successfully")
+	registerSecret(jwtToken.Token)
+	envoy.logger.Infoln("Retrieved long-lived JWT token successfully")
 	return jwtToken, nil
 
 }
 
 // The EPScraper struct just has some config data in it, it should be pretty
 // evident from the variable names what the data is
-func getJWT() (string, error) {
+func getJWT(envoy *envoyClient) (string, error) {
 	// Error handling stripped for brevity
 
 	// We need to have an HTTP client that stores cookies, for reasons that
 	// will become apparent
 	jar, _ := cookiejar.New(nil)
 	client := &http.Client{
-		Jar: jar,
+		Jar:     jar,
+		Timeout: httpTimeout,
 	}
 
 	// First, login using your username and password
-	fieldsLogin := url.Values{"username": {config.String("enphase.EnphaseUser")}, "password": {config.String("enphase.EnphasePassword")}}
+	fieldsLogin := url.Values{"username": {envoy.setting("EnphaseUser")}, "password": {envoy.secret("EnphasePassword")}}
 
-	_, errLogin := client.PostForm("https://entrez.enphaseenergy.com/login", fieldsLogin)
+	_, errLogin := client.PostForm(entrezURL()+"/login", fieldsLogin)
 
 	if errLogin != nil {
 		splunkLogger.WithField("Error", errLogin).Fatalf("Error loggin in to Enphase")
 	}
 
 	// Second give system parameters
-	resp2, _ := client.PostForm("https://entrez.enphaseenergy.com/entrez_tokens",
-		url.Values{"Site": {config.String("enphase.EnphaseSite")}, "serialNum": {config.String("enphase.EnphaseEnvoySerial")}})
+	resp2, _ := client.PostForm(entrezURL()+"/entrez_tokens",
+		url.Values{"Site": {envoy.setting("EnphaseSite")}, "serialNum": {envoy.serial}})
 	// htmlquery is like an xpath library
 	doc, _ := htmlquery.Parse(resp2.Body)
 	textareas := htmlquery.Find(doc, "//textarea[@id=\"JWTToken\"]")
@@ -605,6 +375,47 @@ func getJWT() (string, error) {
 	return htmlquery.InnerText(textareas[0]), nil
 }
 
+// loadLongLivedJWT returns the JWT kept in state for the Envoy, fetching a
+// new one from Enlighten when there is none or it has expired
+func loadLongLivedJWT(envoy *envoyClient) (JWTToken, error) {
+	stateMutex.Lock()
+	longLivedJWT := state.envoyStateFor(envoy.serial).JWT
+	stateMutex.Unlock()
+
+	// Tokens used to be written back into config.yaml, pick that one up once
+	if longLivedJWT.Token == "" && envoy.serial == config.String("enphase.EnphaseEnvoySerial") {
+		tokenExpiry, intError := strconv.Atoi(config.String("enphase.jwtToken.ExpiresAt"))
+		tokenGen, intError2 := strconv.Atoi(config.String("enphase.jwtToken.GenerationTime"))
+		if intError == nil && intError2 == nil {
+			longLivedJWT = JWTToken{config.String("enphase.jwtToken.Token"), tokenExpiry, tokenGen}
+		}
+	}
+
+	if longLivedJWT.Token == "" || time.Unix(int64(longLivedJWT.ExpiresAt), 0).Before(time.Now()) {
+		envoy.logger.Infoln("No valid JWT token found in state")
+		var err error
+		longLivedJWT, err = getLongLivedJWT(envoy)
+		if err != nil {
+			return longLivedJWT, err
+		}
+		envoy.logger.Debugf("Long lived JWT: \n %#v\n", longLivedJWT)
+
+	} else {
+		envoy.logger.WithFields(log.Fields{"JWT_Expiration": time.Unix(int64(longLivedJWT.ExpiresAt), 0).String()}).Infoln("Using stored JWT token")
+
+	}
+
+	registerSecret(longLivedJWT.Token)
+	recordJWTExpiry(envoy.serial, time.Unix(int64(longLivedJWT.ExpiresAt), 0))
+
+	writeStateError := updateState(func(s *collectorState) { s.envoyStateFor(envoy.serial).JWT = longLivedJWT })
+	if writeStateError != nil {
+		envoy.logger.WithFields(log.Fields{"writeStateError": writeStateError, "stateFile": stateFilePath()}).Errorln("Error writing state file")
+	}
+
+	return longLivedJWT, nil
+}
+
 var influxDBcnx influxclient.Client
 
 func connectToInfluxDB() (influxclient.Client, error) {
@@ -612,7 +423,7 @@ func connectToInfluxDB() (influxclient.Client, error) {
 	c, err := influxclient.NewHTTPClient(influxclient.HTTPConfig{
 		Addr:     config.String("influxdb.host"),
 		Username: config.String("influxdb.user"),
-		Password: config.String("influxdb.password"),
+		Password: secret("influxdb.password"),
 	})
 	if err != nil {
 		log.Fatalf("Error creating InfluxDB Client: %s", err.Error())
@@ -633,48 +444,51 @@ func initInfluxDB() influxclient.Client {
 	return influxDBcnx
 }
 
-func scheduleInserts(myJWTtoken string) {
-
-	period := time.Duration(config.Int("influxdb.periodInMinutes"))
-	ticker := time.NewTicker(period * time.Minute)
-
-	senseToken := authSense()
-
-	loadEnphaseDataAndWriteItToInfluxDB(myJWTtoken)
-
-	if senseToken == "" {
-		splunkLogger.Infoln("No Sense token, not getting Sense data")
-		return
-	}
-
-	if config.Bool("sense.enabled") && senseToken != "" {
-		senseData := loadSenseData(senseToken)
-		if senseData != nil {
-			writeSenseDataToInfluxDB(*senseData)
+// pollEnvoy polls one Envoy, a panic is logged and doesn't take down the
+// other Envoys
+func pollEnvoy(envoy *envoyClient) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			envoy.logger.WithFields(log.Fields{"Error": "Envoy poll panicked"}).Error(recovered)
 		}
-	} else {
-		splunkLogger.Infoln("Sense is not enabled, not getting Sense data")
+	}()
+	evaluateAlerts(loadEnphaseDataAndWriteItToInfluxDB(envoy))
+}
 
-	}
+// every calls poll right away and then every period. Polls never overlap: a
+// poll running longer than period is followed right away by one more, the
+// ticks it spanned are dropped.
+func every(period time.Duration, poll func()) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
 
+	poll()
 	for range ticker.C {
+		poll()
+	}
+}
 
-		loadEnphaseDataAndWriteItToInfluxDB(myJWTtoken)
+// scheduleInserts gives every Envoy, and Sense, a ticker of its own so a slow
+// or unreachable one only delays its own polls
+func scheduleInserts(envoys []*envoyClient) {
 
-		if config.Bool("sense.enabled") && senseToken != "" {
-			senseData := loadSenseData(senseToken)
-			if senseData != nil {
-				writeSenseDataToInfluxDB(*senseData)
-			}
+	period := time.Duration(config.Int("influxdb.periodInMinutes")) * time.Minute
 
-		}
+	for _, envoy := range envoys {
+		envoy := envoy
+		go every(period, func() { pollEnvoy(envoy) })
+	}
+
+	if !config.Bool("sense.enabled") {
+		splunkLogger.Infoln("Sense is not enabled, not getting Sense data")
+		select {}
 	}
+	every(period, pollSense)
 }
-func writeSenseDataToInfluxDB(senseTrendsData SenseTrends) {
+func writeSenseDataToInfluxDB(senseTrendsData SenseTrends, eventTime time.Time) {
 	splunkLogger.Infoln("Writing Sense data to InfluxDB")
-	eventTime := time.Now()
 
-	tags := map[string]string{"senseMonitorID": config.String("sense.monitorID")}
+	tags := map[string]string{"senseMonitorID": config.String("sense.monitorID"), "scale": senseTrendsData.Scale}
 
 	fields := map[string]interface{}{
 		"Production":    senseTrendsData.Production.Total,
@@ -685,55 +499,96 @@ func writeSenseDataToInfluxDB(senseTrendsData SenseTrends) {
 		"NetProduction": senseTrendsData.NetProduction,
 		"ProductionPct": senseTrendsData.ProductionPct,
 	}
-	writeToInfluxDB(influxDBcnx, "sense", tags, fields, eventTime)
+	writeErrors := 0
+	if writeToInfluxDB(influxDBcnx, "sense", tags, fields, eventTime) != nil {
+		writeErrors++
+	}
+
+	for direction, devices := range map[string][]SenseDevice{"consumption": senseTrendsData.Consumption.Devices, "production": senseTrendsData.Production.Devices} {
+		for _, device := range devices {
+			deviceType, _ := device.Tags["UserDeviceTypeDisplayString"].(string)
+			deviceTags := map[string]string{
+				"senseMonitorID": config.String("sense.monitorID"),
+				"scale":          senseTrendsData.Scale,
+				"direction":      direction,
+				"deviceID":       device.ID,
+				"deviceName":     device.Name,
+				"deviceType":     deviceType,
+			}
+			deviceFields := map[string]interface{}{
+				"TotalKwh":  device.TotalKwh,
+				"AvgW":      device.Avgw,
+				"Pct":       device.Pct,
+				"TotalCost": device.TotalCost,
+			}
+			if writeToInfluxDB(influxDBcnx, "sense_devices", deviceTags, deviceFields, eventTime) != nil {
+				writeErrors++
+			}
+		}
+	}
+
+	splunkLogger.WithFields(fields).WithFields(log.Fields{"event": "sense_poll_summary", "scale": senseTrendsData.Scale, "devices": len(senseTrendsData.Consumption.Devices) + len(senseTrendsData.Production.Devices), "writeErrors": writeErrors}).Infoln("Sense poll summary")
 
 }
 
-func loadSenseData(senseToken string) *SenseTrends {
+// loadSenseData returns errSenseUnauthorized when Sense no longer accepts the token
+func loadSenseData(senseToken string, scale string) (*SenseTrends, error) {
 
-	beginingOfDay := time.Now().Round(24 * time.Hour)
+	// Sense wants the start of the period at the site, as a UTC instant
+	start := startOfPeriod(time.Now(), scale).UTC()
 
-	url := "https://api.sense.com/apiservice/api/v1/app/history/trends?monitor_id=" + config.String("sense.monitorID") + "&scale=DAY&start=" + beginingOfDay.Format("2006-01-02T15:04:05.000Z")
+	url := senseURL() + "/apiservice/api/v1/app/history/trends?monitor_id=" + config.String("sense.monitorID") + "&scale=" + scale + "&start=" + start.Format("2006-01-02T15:04:05.000Z")
 	splunkLogger.WithFields(log.Fields{"URL": url}).Infoln("Retrieving Sense data from unofficial API")
 
 	method := "GET"
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: httpTimeout}
 	req, err := http.NewRequest(method, url, nil)
 
 	if err != nil {
 		splunkLogger.WithField("Error", err).WithField("monitor_id", config.String("sense.monitorID")).WithField("URL", url).Error("Error retrieving tren sense data")
-		return nil
+		return nil, err
 	}
 	req.Header.Add("Authorization", "Bearer "+senseToken)
 
 	res, err := client.Do(req)
 	if err != nil {
 		splunkLogger.Error(err)
-		return nil
+		return nil, err
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, errSenseUnauthorized
+	}
 	if res.StatusCode != 200 {
 		splunkLogger.WithFields(log.Fields{"responseStatusCode": res.StatusCode}).Infoln("Got a non-200 response from Sense API")
 
-		return nil
+		return nil, fmt.Errorf("sense API returned %s", res.Status)
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		splunkLogger.Error(err)
-		return nil
+		return nil, err
 	}
+	recordResponse("sense", "", body)
 
+	senseData := decodeSenseData(body)
+	if senseData == nil {
+		return nil, errors.New("error unmarshalling Sense data")
+	}
+	return senseData, nil
+}
+
+func decodeSenseData(body []byte) *SenseTrends {
 	senseTrendsData := SenseTrends{}
-	unmarshalError := json.Unmarshal([]byte(body), &senseTrendsData)
+	unmarshalError := json.Unmarshal(body, &senseTrendsData)
 
 	if unmarshalError != nil {
 
-		splunkLogger.WithFields(log.Fields{"responseBody": string(body), "unmarshalError": unmarshalError}).Fatalln("Error unmarshalling Sense data")
-
-		// panic(0)
+		splunkLogger.WithFields(log.Fields{"responseBody": string(body), "unmarshalError": unmarshalError}).Errorln("Error unmarshalling Sense data")
+		return nil
 	}
 	splunkLogger.WithFields(log.Fields{
 		"Production": senseTrendsData.Production.Total, "Consumption": senseTrendsData.Consumption.Total, "ToGrid": senseTrendsData.ToGrid, "FromGrid": senseTrendsData.FromGrid, "SolarPowered": senseTrendsData.SolarPowered, "NetProduction": senseTrendsData.NetProduction, "ProductionPct": senseTrendsData.ProductionPct}).Infoln("Retrieved Sense Trends data successfully")
@@ -741,25 +596,144 @@ func loadSenseData(senseToken string) *SenseTrends {
 
 }
 
-func loadEnphaseDataAndWriteItToInfluxDB(myJWTtoken string) {
-	log.Infoln("Retrieving Enphase Production data, from local endpoint")
-	enphaseData := loadProductionDetailsData(myJWTtoken)
+// pollResult is what one Enphase poll saw, it is handed to the alert engine
+type pollResult struct {
+	Envoy     *envoyClient
+	Time      time.Time
+	Metrics   *enphaseMetrics
+	Inverters Inverters
+	Meters    []meterReading
+	// Reachable is set once the production data is in, whatever fails after
+	Reachable bool
+	Err       error
+}
 
-	for _, data := range enphaseData.Production {
+func loadEnphaseDataAndWriteItToInfluxDB(envoy *envoyClient) pollResult {
+	envoy.logger.Infoln("Retrieving Enphase Production data, from local endpoint")
+	result := pollResult{Envoy: envoy, Time: time.Now()}
+
+	if envoy.baseURL == "" && !envoy.rediscover() {
+		result.Err = fmt.Errorf("no EnvoyHost configured and Envoy %s not discovered", envoy.serial)
+		envoy.logger.WithFields(log.Fields{"event": "poll_summary", "Error": result.Err}).Errorln("Enphase poll failed")
+		return result
+	}
+	if !envoy.authDetected {
+		envoy.detectAuth()
+	}
+	if tokenError := envoy.ensureToken(); tokenError != nil {
+		result.Err = tokenError
+		envoy.logger.WithFields(log.Fields{"event": "poll_summary", "Error": tokenError}).Errorln("Enphase poll failed, no JWT")
+		return result
+	}
+
+	enphaseData, loadError := loadProductionDetailsData(envoy)
+	// The Envoy not answering at all may mean DHCP moved it
+	if envoyUnreachable(loadError) && envoy.rediscover() {
+		enphaseData, loadError = loadProductionDetailsData(envoy)
+	}
+	if loadError != nil {
+		result.Err = loadError
+		envoy.logger.WithFields(log.Fields{"event": "poll_summary", "Error": loadError}).Errorln("Enphase poll failed")
+		return result
+	}
+	recordEnvoyPoll(envoy.serial)
+	result.Metrics = &enphaseData
+	result.Reachable = true
+	envoy.lastSuccess = result.Time
+
+	summary := log.Fields{"event": "poll_summary"}
+	validations := validateProductionData(envoy, enphaseData, result.Time)
+	writeErrors := writeProductionData(envoy, enphaseData, validations, result.Time, summary)
+
+	envoy.logger.Infoln("Retrieving Enphase Inverter data, from local endpoint")
+	invertersData, loadError := loadInverterData(envoy)
+	if loadError != nil {
+		result.Err = loadError
+	}
+	result.Inverters = invertersData
 
-		eventTime := time.Now()
+	writeErrors += writeInverterData(envoy, invertersData, 0, summary)
 
-		tags := map[string]string{"serial": config.String("enphase.EnphaseEnvoySerial"), "type": data.Type}
+	if envoy.settingBool("inverterDetails.enabled") {
+		writeErrors += loadInverterDetails(envoy)
+	}
+
+	if envoy.settingBool("meters.enabled", envoy.hasMeters()) {
+		meterReadings, metersError := loadMeterReadings(envoy)
+		if metersError != nil {
+			envoy.logger.WithFields(log.Fields{"Error": "Error loading meter readings"}).Warn(metersError)
+			summary["metersError"] = metersError
+		}
+		result.Meters = meterReadings
+		writeErrors += writeMeterReadings(envoy, meterReadings, 0)
+		summary["meterCount"] = len(meterReadings)
+	}
+
+	writeErrors += trackPowerQuality(result)
+
+	if envoy.settingBool("ensemble.enabled") {
+		writeErrors += trackOutages(envoy, result)
+	}
+
+	if envoy.settingBool("rollups.enabled", true) {
+		writeErrors += trackRollups(envoy, result)
+	}
+
+	if envoy.settingBool("status.enabled", true) {
+		writeErrors += writeEnvoyStatus(envoy, result.Time)
+	}
+
+	if envoy.settingBool("events.enabled") {
+		writeErrors += loadEnvoyEvents(envoy, result.Time)
+	}
+
+	summary["writeErrors"] = writeErrors
+	if result.Err != nil {
+		summary["Error"] = result.Err
+	}
+	envoy.logger.WithFields(summary).Infoln("Enphase poll summary")
+
+	return result
+}
+
+// envoyUnreachable tells whether err says nothing answered at the address of
+// the Envoy: the connection couldn't be made, or timed out. Errors from an
+// Envoy that did answer, TLS and HTTP errors included, don't.
+func envoyUnreachable(err error) bool {
+	var opError *net.OpError
+	if errors.As(err, &opError) && opError.Op == "dial" {
+		return true
+	}
+	var netError net.Error
+	return errors.As(err, &netError) && netError.Timeout()
+}
+
+// writeProductionData writes the production and consumption points of one
+// production.json reading, it returns the number of failed writes
+func writeProductionData(envoy *envoyClient, enphaseData enphaseMetrics, validations map[string]validation, eventTime time.Time, summary log.Fields) int {
+	writeErrors := 0
+
+	for _, data := range enphaseData.Production {
+
+		tags := map[string]string{"serial": envoy.serial, "site": envoy.name, "type": data.Type}
 
 		fields := map[string]interface{}{
-			"whLifetime":           int(data.WhLifetime),
+			"whLifetime":           data.WhLifetime,
 			"WhLastSevenDays":      data.WhLastSevenDays,
 			"WhToday":              data.WhToday,
-			"WNow":                 int(data.WNow),
+			"WNow":                 data.WNow,
 			"activeInverterCounts": data.ActiveCount,
 		}
+		if data.RmsVoltage != 0 {
+			fields["rmsVoltage"] = data.RmsVoltage
+		}
+		applyValidation(validations, validationKey("production", data.Type), fields)
 
-		writeToInfluxDB(influxDBcnx, "production", tags, fields, eventTime)
+		if writeToInfluxDB(influxDBcnx, "production", tags, fields, eventTime) != nil {
+			writeErrors++
+		}
+		summary["production_"+data.Type+"_WNow"] = data.WNow
+		summary["production_"+data.Type+"_WhToday"] = data.WhToday
 
 		// b, _ := json.Marshal(fields)
 		// fmt.Println(string(b))
@@ -776,19 +750,25 @@ func loadEnphaseDataAndWriteItToInfluxDB(myJWTtoken string) {
 
 	for _, data := range enphaseData.Consumption {
 
-		eventTime := time.Now()
-
-		tags := map[string]string{"serial": config.String("enphase.EnphaseEnvoySerial"), "type": data.MeasurementType}
+		tags := map[string]string{"serial": envoy.serial, "site": envoy.name, "type": data.MeasurementType}
 
 		fields := map[string]interface{}{
 			"whLifetime":      data.WhLifetime,
 			"WhLastSevenDays": data.WhLastSevenDays,
 			"WhToday":         data.WhToday,
 		}
+		if data.RmsVoltage != 0 {
+			fields["rmsVoltage"] = data.RmsVoltage
+		}
+		applyValidation(validations, validationKey("consumption", data.MeasurementType), fields)
 		splunkLogger.Debugf("WhLifeTime: \n %#v\n", data.WhLifetime)
 		// log.Debug(tags, fields)
 
-		writeToInfluxDB(influxDBcnx, "consumption", tags, fields, eventTime)
+		if writeToInfluxDB(influxDBcnx, "consumption", tags, fields, eventTime) != nil {
+			writeErrors++
+		}
+		summary["consumption_"+data.MeasurementType+"_WNow"] = data.WNow
+		summary["consumption_"+data.MeasurementType+"_WhToday"] = data.WhToday
 
 		// log.Infof("Today's Consumption (%s): %f", data.MeasurementType, data.WhToday)
 		splunkLogger.WithFields(log.Fields{"MeasurementType": data.MeasurementType, "WhToday": data.WhToday}).Debugln("Today's Consumption")
@@ -799,29 +779,34 @@ func loadEnphaseDataAndWriteItToInfluxDB(myJWTtoken string) {
 
 	}
 
-	splunkLogger.Infoln("Retrieving Enphase Inverter data, from local endpoint")
-	invertersData := loadInverterData(myJWTtoken)
+	return writeErrors
+}
+
+// writeInverterData writes one point per inverter at its last report date,
+// moved by shift when replaying recordings
+func writeInverterData(envoy *envoyClient, invertersData Inverters, shift time.Duration, summary log.Fields) int {
+	writeErrors := 0
 
 	totalInverters := 0
 	for _, data_inverter := range invertersData {
 
 		// eventTime := time.Now()
-		eventTime := time.Unix(int64(data_inverter.Lastreportdate), 0)
+		eventTime := time.Unix(int64(data_inverter.Lastreportdate), 0).Add(shift)
 
 		inverterSerial := data_inverter.Serialnumber
 
-		inverterID := inverterSerial[len(inverterSerial)-5:]
-
-		tags := map[string]string{"serial": config.String("enphase.EnphaseEnvoySerial"), "inverter": inverterID}
+		tags := map[string]string{"serial": envoy.serial, "site": envoy.name, "inverter": inverterSerial}
 
 		fields := map[string]interface{}{
 			"lastReportWatts": data_inverter.Lastreportwatts,
 			"maxReportWatts":  data_inverter.Maxreportwatts,
 		}
 
-		splunkLogger.WithFields(fields).WithField("inverter", inverterID).WithField("tags", fmt.Sprint(tags)).Debug("Inverter data")
+		splunkLogger.WithFields(fields).WithField("inverter", inverterSerial).WithField("tags", fmt.Sprint(tags)).Debug("Inverter data")
 
-		writeToInfluxDB(influxDBcnx, "inverters", tags, fields, eventTime)
+		if writeToInfluxDB(influxDBcnx, "inverters", tags, fields, eventTime) != nil {
+			writeErrors++
+		}
 		totalInverters += data_inverter.Lastreportwatts
 
 	}
@@ -830,27 +815,13 @@ func loadEnphaseDataAndWriteItToInfluxDB(myJWTtoken string) {
 	splunkLogger.WithField("TotalReportedWatts", totalInverters).Debug("Total Reported Watts for Inverters")
 	// }
 
-}
-
-func writeConfig() error {
-
-	splunkLogger.Infoln("Writing config to file")
-
-	buf := new(bytes.Buffer)
-
-	_, dumpError := config.DumpTo(buf, config.Yaml)
-	if dumpError != nil {
-		return dumpError
-	}
-	writeError := ioutil.WriteFile(configFilePath, buf.Bytes(), 0755)
-	if writeError != nil {
-		return writeError
-	}
-	return nil
+	summary["inverterCount"] = len(invertersData)
+	summary["inverterReportedWatts"] = totalInverters
 
+	return writeErrors
 }
 
-func loadJWTIntoCookie(jwt string) (cookiejar.Jar, error) {
+func loadJWTIntoCookie(envoy *envoyClient, jwt string) (*cookiejar.Jar, error) {
 	// You need to empty the cookie jar before trying to load a new JWT in.
 	// If you have an old cookie from a previous JWT auth, it gets confused and you don't end
 	// up "refreshing" your auth. Then your system breaks when you hit the expiry time
@@ -860,14 +831,11 @@ func loadJWTIntoCookie(jwt string) (cookiejar.Jar, error) {
 	}
 	// Erase the cookies in the scraper's client bc the envoy doesn't seem to overwrite the
 	// jwt if there is one in the session already
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr,
+	client := &http.Client{Transport: envoy.client.Transport,
 		Jar: jar,
 	}
 
-	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/auth/check_jwt", config.String("enphase.EnvoyHost")), nil)
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/auth/check_jwt", envoy.baseURL), nil)
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", jwt))
 	requestResponse, requestError := client.Do(req)
 	if requestError != nil {
@@ -879,93 +847,101 @@ func loadJWTIntoCookie(jwt string) (cookiejar.Jar, error) {
 	// All we needed was the cookie, which is now in ep.client.Jar
 	splunkLogger.Infoln("Retrieved cookies successfully from JWT auth page")
 
-	return *jar, nil
+	return jar, nil
 }
-func loadProductionDetailsData(myJWTtoken string) enphaseMetrics {
-	// /production.json?details=1
-
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
-
-	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/production.json?details=1", config.String("enphase.EnvoyHost")), nil)
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", myJWTtoken))
+func loadProductionDetailsData(envoy *envoyClient) (enphaseMetrics, error) {
+	res := enphaseMetrics{}
 
-	requestResponse, requestError := client.Do(req)
+	requestResponse, requestError := envoy.get("/production.json?details=1")
 	if requestError != nil {
-		log.Fatalln(requestError)
+		splunkLogger.WithFields(log.Fields{"Error": "Error making HTTP call to Envoy"}).Error(requestError)
+		return res, requestError
 	}
 
 	defer requestResponse.Body.Close()
 
+	if requestResponse.StatusCode != 200 {
+		splunkLogger.WithFields(log.Fields{"responseStatusCode": requestResponse.StatusCode}).Errorln("Got a non-200 response from Envoy production endpoint")
+		return res, fmt.Errorf("envoy production endpoint returned %s", requestResponse.Status)
+	}
+
 	body, err := ioutil.ReadAll(requestResponse.Body)
 	if err != nil {
-		splunkLogger.Fatalln(err)
+		splunkLogger.Error(err)
+		return res, err
 	}
 
 	splunkLogger.WithFields(log.Fields{"Response": body}).Debug("Production details response from Enphase API")
+	recordResponse("production", envoy.serial, body)
+
+	return decodeProductionDetailsData(body)
+}
 
+func decodeProductionDetailsData(body []byte) (enphaseMetrics, error) {
 	res := enphaseMetrics{}
-	unMarshalError := json.Unmarshal([]byte(body), &res)
+	unMarshalError := json.Unmarshal(body, &res)
 
 	if unMarshalError != nil {
 
-		splunkLogger.WithFields(log.Fields{"responseBody": string(body), "unmarshalError": unMarshalError}).Fatalln("Error unmarshalling Sense data")
+		splunkLogger.WithFields(log.Fields{"responseBody": string(body), "unmarshalError": unMarshalError}).Errorln("Error unmarshalling Enphase production data")
+		return res, unMarshalError
 	}
 
 	splunkLogger.Infoln("Retrieved Enphase production data successfully from local endpoint")
 
-	return res
+	return res, nil
 
 }
 
-func loadInverterData(myJWTtoken string) Inverters {
-	// /api/v1/production/inverters
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
-
-	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/production/inverters", config.String("enphase.EnvoyHost")), nil)
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", myJWTtoken))
+func loadInverterData(envoy *envoyClient) (Inverters, error) {
+	res := Inverters{}
 
-	requestResponse, requestError := client.Do(req)
+	requestResponse, requestError := envoy.get("/api/v1/production/inverters")
 	if requestError != nil {
-		log.Fatalln(requestError)
+		splunkLogger.WithFields(log.Fields{"Error": "Error making HTTP call to Envoy"}).Error(requestError)
+		return res, requestError
 	}
 	log.Debugln(requestResponse)
 
 	defer requestResponse.Body.Close()
 
+	if requestResponse.StatusCode != 200 {
+		splunkLogger.WithFields(log.Fields{"responseStatusCode": requestResponse.StatusCode}).Errorln("Got a non-200 response from Envoy inverters endpoint")
+		return res, fmt.Errorf("envoy inverters endpoint returned %s", requestResponse.Status)
+	}
+
 	body, err := ioutil.ReadAll(requestResponse.Body)
 	if err != nil {
-		log.Fatalln(err)
+		splunkLogger.Error(err)
+		return res, err
 	}
+	recordResponse("inverters", envoy.serial, body)
 
+	return decodeInverterData(body)
+}
+
+func decodeInverterData(body []byte) (Inverters, error) {
 	res := Inverters{}
-	unmarshalError := json.Unmarshal([]byte(body), &res)
+	unmarshalError := json.Unmarshal(body, &res)
 
 	if unmarshalError != nil {
-		splunkLogger.WithFields(log.Fields{"responseBody": string(body), "unmarshalError": unmarshalError}).Fatalln("Error unmarshalling Sense data")
+		splunkLogger.WithFields(log.Fields{"responseBody": string(body), "unmarshalError": unmarshalError}).Errorln("Error unmarshalling Enphase inverter data")
+		return res, unmarshalError
 	}
 
 	log.Infoln("Retrieved Enphase inverter data successfully from local endpoint")
 
-	return res
+	return res, nil
 
 }
 
-func loadStreamData(authedCookieJar cookiejar.Jar) {
+func loadStreamData(envoy *envoyClient, authedCookieJar *cookiejar.Jar) {
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr,
-		Jar: &authedCookieJar,
+	client := &http.Client{Transport: envoy.client.Transport,
+		Jar: authedCookieJar,
 	}
 
-	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/stream/meter", config.String("enphase.EnvoyHost")), nil)
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/stream/meter", envoy.baseURL), nil)
 	// req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.String("enphase.jwtToken.Token")))
 	// req.SetBasicAuth("installer", "107334")
 
@@ -1004,14 +980,24 @@ func initLoggers() {
 	log.SetReportCaller(true)
 	// }
 
+	// Must come before any other hook so nothing downstream sees a secret
+	log.AddHook(redactHook{})
+
 	splunkLogger = log.WithFields(log.Fields{"app": APPNAME})
 
+	for _, key := range secretKeys {
+		secret(key)
+	}
+
+	initLogShipping()
+
 	splunkLogger.Info("Loggers initialized")
 
 }
 
 func main() {
 
+	flag.Parse()
 	setupConfig()
 	initLoggers()
 
@@ -1019,36 +1005,51 @@ func main() {
 
 	splunkLogger.Debug("Config loaded")
 
-	tokenExpiry, intError := strconv.Atoi(config.String("enphase.jwtToken.ExpiresAt"))
-	tokenGen, intError2 := strconv.Atoi(config.String("enphase.jwtToken.GenerationTime"))
-	token := config.String("enphase.jwtToken.Token")
-
-	var longLivedJWT JWTToken
-
-	if token == "" || intError != nil || intError2 != nil || time.Unix(int64(tokenExpiry), 0).Before(time.Now()) {
-		splunkLogger.Infoln("No JWT token found in config")
-		longLivedJWT, _ = getLongLivedJWT()
-		splunkLogger.Debugf("Long lived JWT: \n %#v\n", longLivedJWT)
+	switch flag.Arg(0) {
+	case "discover":
+		runDiscoverCommand()
+		return
+	case "schema":
+		printSchema()
+		return
+	case "migrate":
+		runMigrateCommand()
+		return
+	}
 
-		// Not sure if I love this
-		config.Set("enphase.jwtToken.Token", longLivedJWT.Token)
-		config.Set("enphase.jwtToken.ExpiresAt", longLivedJWT.ExpiresAt)
-		config.Set("enphase.jwtToken.GenerationTime", longLivedJWT.GenerationTime)
+	if *replayDir != "" {
+		influxDBcnx = initInfluxDB()
+		replayRecordings()
+		return
+	}
 
-		writeConfigError := writeConfig()
-		if writeConfigError != nil {
-			splunkLogger.WithFields(log.Fields{"writeConfigError": writeConfigError}).Fatalln("Error writing config file")
+	if *recordDir != "" {
+		if mkdirError := os.MkdirAll(*recordDir, 0700); mkdirError != nil {
+			splunkLogger.WithFields(log.Fields{"mkdirError": mkdirError, "recordDir": *recordDir}).Fatalln("Error creating recording directory")
 		}
+		splunkLogger.WithField("recordDir", *recordDir).Infoln("Recording every response")
+	}
 
-	} else {
-		longLivedJWT = JWTToken{token, tokenExpiry, tokenGen}
+	startHealthServer()
 
-		splunkLogger.WithFields(log.Fields{"JWT_Expiration": time.Unix(int64(tokenExpiry), 0).String()}).Infoln("Using stored JWT token")
+	loadStateError := loadState()
+	if loadStateError != nil {
+		splunkLogger.WithFields(log.Fields{"loadStateError": loadStateError, "stateFile": stateFilePath()}).Fatalln("Error reading state file")
+	}
 
+	envoys := configuredEnvoys()
+	for _, envoy := range envoys {
+		registerEnvoyHealth(envoy.serial)
+		envoy.logger.WithField("host", envoy.baseURL).Infoln("Polling Envoy")
 	}
 
 	influxDBcnx = initInfluxDB()
+	checkSchemaVersion(influxDBcnx)
+
+	if config.Bool("sense.enabled") && config.Bool("sense.realtime.enabled") {
+		go runSenseRealtime()
+	}
 
-	scheduleInserts(longLivedJWT.Token)
+	scheduleInserts(envoys)
 
 }
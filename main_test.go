@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gookit/config/v2"
+)
+
+func TestLoadEnphaseDataAndWriteItToInfluxDB(t *testing.T) {
+	influx := setupTest(t)
+	enlighten := newFakeEnlighten(t, nil)
+	envoy := newTestEnvoy(t, newFakeEnvoy(t, nil).URL, enlighten.URL)
+
+	result := loadEnphaseDataAndWriteItToInfluxDB(envoy)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if !result.Reachable {
+		t.Error("poll not reported as reachable")
+	}
+	if envoy.auth != envoyAuthJWT || envoy.token != fakeEnlightenToken(t) {
+		t.Errorf("auth %q with token %q, want the Enlighten token", envoy.auth, envoy.token)
+	}
+
+	now := strconv.FormatInt(result.Time.UnixNano(), 10)
+	expected := []string{
+		`consumption,serial=122012345678,site=home,type=net-consumption WhLastSevenDays=0,WhToday=0,rmsVoltage=241.5,whLifetime=1219998.75 ` + now,
+		`consumption,serial=122012345678,site=home,type=total-consumption WhLastSevenDays=99120.5,WhToday=14200.75,rmsVoltage=241.5,whLifetime=2450000.25,whLifetimeCorrected=2450000.25 ` + now,
+		`envoy_status,serial=122012345678,site=home alertCount=0i,alerts="",commLevel=5i,commNum=2i,firmware="D7.6.175",imeter=true,partNumber="800-00654-r08",pcuCommLevel=5i,pcuNum=2i,primaryInterface="wlan0",updateStatus="satisfied",webComm=true,wifiCarrier=true,wifiSignal=4i,wifiSignalMax=5i ` + now,
+		`inverters,inverter=482212345601,serial=122012345678,site=home lastReportWatts=257,maxReportWatts=295 1699999950000000000`,
+		`inverters,inverter=482212345602,serial=122012345678,site=home lastReportWatts=255,maxReportWatts=293 1699999980000000000`,
+		`meters,channel=total,eid=704643328,measurementType=production,phaseMode=split,serial=122012345678,site=home,state=enabled actEnergyDlvd=1230001.5,actEnergyRcvd=12.5,activePower=498.25,apparentEnergy=1400210.4,apparentPower=510.7,current=4.21,freq=60.01,instantaneousDemand=498.25,pwrFactor=0.98,reactEnergyLagg=311.2,reactEnergyLead=0.13,reactivePower=102.1,voltage=241.6 1700000010000000000`,
+		`meters,channel=total,eid=704643584,measurementType=net-consumption,phaseMode=split,serial=122012345678,site=home,state=enabled actEnergyDlvd=2101000.25,actEnergyRcvd=881001.5,activePower=822.25,apparentEnergy=3100000.5,apparentPower=891.4,current=7.1,freq=60.01,instantaneousDemand=822.25,pwrFactor=0.92,reactEnergyLagg=0,reactEnergyLead=0,reactivePower=-403.5,voltage=241.5 1700000010000000000`,
+		`production,serial=122012345678,site=home,type=eim WNow=498.25,WhLastSevenDays=61200.25,WhToday=8150.5,activeInverterCounts=1i,rmsVoltage=241.6,whLifetime=1230001.5,whLifetimeCorrected=1230001.5 ` + now,
+		`production,serial=122012345678,site=home,type=inverters WNow=512,WhLastSevenDays=0,WhToday=0,activeInverterCounts=2i,whLifetime=1234567,whLifetimeCorrected=1234567 ` + now,
+	}
+	assertLines(t, influx.lines(), expected)
+
+	stateMutex.Lock()
+	storedToken := state.envoyStateFor(testEnvoySerial).JWT.Token
+	stateMutex.Unlock()
+	if storedToken != envoy.token {
+		t.Error("Enlighten token not kept in state")
+	}
+}
+
+func assertLines(t *testing.T, lines []string, expected []string) {
+	t.Helper()
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("points written:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestLoadEnphaseDataEnvoyErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		handlers map[string]http.HandlerFunc
+		timeout  bool
+	}{
+		{"unauthorized", map[string]http.HandlerFunc{"/production.json": unauthorizedHandler}, false},
+		{"timeout", map[string]http.HandlerFunc{"/production.json": slowHandler}, true},
+		{"malformed JSON", map[string]http.HandlerFunc{"/production.json": malformedJSONHandler}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			influx := setupTest(t)
+			defer func(timeout time.Duration) { httpTimeout = timeout }(httpTimeout)
+			httpTimeout = 100 * time.Millisecond
+			enlighten := newFakeEnlighten(t, nil)
+			envoy := newTestEnvoy(t, newFakeEnvoy(t, test.handlers).URL, enlighten.URL)
+
+			result := loadEnphaseDataAndWriteItToInfluxDB(envoy)
+			if result.Err == nil {
+				t.Fatal("poll succeeded")
+			}
+			if result.Reachable || result.Metrics != nil {
+				t.Error("failed poll reported as reachable")
+			}
+			if lines := influx.lines(); len(lines) != 0 {
+				t.Errorf("points written after a failed poll:\n%s", strings.Join(lines, "\n"))
+			}
+			if timeout := isTimeout(result.Err); timeout != test.timeout {
+				t.Errorf("timeout %v for %v", timeout, result.Err)
+			}
+		})
+	}
+}
+
+func isTimeout(err error) bool {
+	var timeoutError interface{ Timeout() bool }
+	return errors.As(err, &timeoutError) && timeoutError.Timeout()
+}
+
+func TestLoadEnphaseDataInvertersFailing(t *testing.T) {
+	influx := setupTest(t)
+	config.Set("enphase.status.enabled", false)
+	config.Set("enphase.meters.enabled", false)
+	enlighten := newFakeEnlighten(t, nil)
+	envoy := newTestEnvoy(t, newFakeEnvoy(t, map[string]http.HandlerFunc{"/api/v1/production/inverters": malformedJSONHandler}).URL, enlighten.URL)
+
+	result := loadEnphaseDataAndWriteItToInfluxDB(envoy)
+	if result.Err == nil {
+		t.Error("inverter error not reported")
+	}
+	if !result.Reachable {
+		t.Error("Envoy reported unreachable though production was read")
+	}
+	for _, line := range influx.lines() {
+		if strings.HasPrefix(line, "inverters,") {
+			t.Errorf("inverter point written from malformed JSON: %s", line)
+		}
+	}
+	if len(influx.lines()) != 4 {
+		t.Errorf("%d points written, want the 4 production and consumption points", len(influx.lines()))
+	}
+}
+
+func TestGetLongLivedJWT(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		handler  http.HandlerFunc
+		timeout  bool
+	}{
+		{"wrong password", "wrong", nil, false},
+		{"unauthorized", testPassphrase, unauthorizedHandler, false},
+		{"timeout", testPassphrase, slowHandler, true},
+		{"malformed JSON", testPassphrase, malformedJSONHandler, false},
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		setupTest(t)
+		envoy := newTestEnvoy(t, "https://envoy.invalid", newFakeEnlighten(t, nil).URL)
+		token, err := getLongLivedJWT(envoy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Token != fakeEnlightenToken(t) || token.ExpiresAt != 4102444800 || token.GenerationTime != 1700000000 {
+			t.Errorf("got token %+v", token)
+		}
+	})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			defer func(timeout time.Duration) { httpTimeout = timeout }(httpTimeout)
+			httpTimeout = 100 * time.Millisecond
+			envoy := newTestEnvoy(t, "https://envoy.invalid", newFakeEnlighten(t, test.handler).URL)
+			config.Set("enphase.EnphasePassword", test.password)
+
+			token, err := getLongLivedJWT(envoy)
+			if err == nil || token.Token != "" {
+				t.Fatalf("got token %+v, error %v", token, err)
+			}
+			if timeout := isTimeout(err); timeout != test.timeout {
+				t.Errorf("timeout %v for %v", timeout, err)
+			}
+		})
+	}
+}
+
+func TestPollSense(t *testing.T) {
+	influx := setupTest(t)
+	config.Set("sense.enabled", true)
+	config.Set("sense.apiURL", newFakeSense(t, nil).URL)
+	config.Set("sense.username", testSenseUser)
+	config.Set("sense.password", testPassphrase)
+	config.Set("sense.monitorID", "12345")
+
+	pollSense()
+
+	lines := influx.lines()
+	for i, line := range lines {
+		// Sense trends are written at the time of the poll
+		lines[i] = line[:strings.LastIndex(line, " ")]
+	}
+	assertLines(t, lines, []string{
+		`sense,scale=DAY,senseMonitorID=12345 Consumption=14.2,FromGrid=8.1,NetProduction=-6.05,Production=8.15,ProductionPct=57i,SolarPowered=43i,ToGrid=2.05`,
+		`sense_devices,deviceID=a1b2c3,deviceName=Fridge,deviceType=Fridge,direction=consumption,scale=DAY,senseMonitorID=12345 AvgW=61.25,Pct=10.4,TotalCost=22,TotalKwh=1.47`,
+		`sense_devices,deviceID=always_on,deviceName=Always\ On,deviceType=Always\ On,direction=consumption,scale=DAY,senseMonitorID=12345 AvgW=180.5,Pct=30.5,TotalCost=65,TotalKwh=4.33`,
+	})
+}
+
+func TestLoadSenseDataErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		check   func(err error) bool
+	}{
+		{"unauthorized", unauthorizedHandler, func(err error) bool { return errors.Is(err, errSenseUnauthorized) }},
+		{"timeout", slowHandler, isTimeout},
+		{"malformed JSON", malformedJSONHandler, func(err error) bool { return err != nil && !errors.Is(err, errSenseUnauthorized) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			defer func(timeout time.Duration) { httpTimeout = timeout }(httpTimeout)
+			httpTimeout = 100 * time.Millisecond
+			config.Set("sense.apiURL", newFakeSense(t, test.handler).URL)
+			config.Set("sense.monitorID", "12345")
+
+			data, err := loadSenseData("t1.v2.sense-test-access-token", "DAY")
+			if data != nil || !test.check(err) {
+				t.Errorf("got %+v, error %v", data, err)
+			}
+		})
+	}
+}
+
+func TestAuthSense(t *testing.T) {
+	for password, expected := range map[string]string{"wrong": "", testPassphrase: "t1.v2.sense-test-access-token"} {
+		setupTest(t)
+		config.Set("sense.apiURL", newFakeSense(t, nil).URL)
+		config.Set("sense.username", testSenseUser)
+		config.Set("sense.password", password)
+
+		if token := authSense(); token != expected {
+			t.Errorf("password %q got token %q, want %q", password, token, expected)
+		}
+	}
+}
+
+func TestEnvoyUnreachable(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	slow := httptest.NewServer(http.HandlerFunc(slowHandler))
+	defer slow.Close()
+	selfSigned := httptest.NewTLSServer(http.NotFoundHandler())
+	defer selfSigned.Close()
+
+	get := func(url string, timeout time.Duration) error {
+		res, err := (&http.Client{Timeout: timeout}).Get(url)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"connection refused", get(closed.URL, 5*time.Second), true},
+		{"timeout", get(slow.URL, 100*time.Millisecond), true},
+		{"certificate rejected", get(selfSigned.URL, 5*time.Second), false},
+		{"HTTP error", fmt.Errorf("envoy production endpoint returned %s", "401 Unauthorized"), false},
+		{"no error", nil, false},
+	}
+	for _, test := range tests {
+		if unreachable := envoyUnreachable(test.err); unreachable != test.expected {
+			t.Errorf("%s: envoyUnreachable(%v) = %v", test.name, test.err, unreachable)
+		}
+	}
+}
+
+func TestLoadEnphaseDataWithoutMeters(t *testing.T) {
+	influx := setupTest(t)
+	config.Set("enphase.status.enabled", false)
+	meterCalls := 0
+	countMeterCalls := func(w http.ResponseWriter, r *http.Request) {
+		meterCalls++
+		http.NotFound(w, r)
+	}
+	unmeteredInfo := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Replace(string(fixture(t, "envoy/info.xml")), "<imeter>true</imeter>", "<imeter>false</imeter>", 1)))
+	}
+	handlers := map[string]http.HandlerFunc{"/info.xml": unmeteredInfo, "/ivp/meters": countMeterCalls, "/ivp/meters/readings": countMeterCalls}
+	envoy := newTestEnvoy(t, newFakeEnvoy(t, handlers).URL, newFakeEnlighten(t, nil).URL)
+
+	for i := 0; i < 2; i++ {
+		if result := loadEnphaseDataAndWriteItToInfluxDB(envoy); result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+	if meterCalls != 0 {
+		t.Errorf("%d calls to the meter endpoints of an Envoy without CTs", meterCalls)
+	}
+	for _, line := range influx.lines() {
+		if strings.HasPrefix(line, "meters,") {
+			t.Errorf("meter point written: %s", line)
+		}
+	}
+}
+
+func TestLoadEnphaseDataInverterInventory(t *testing.T) {
+	influx := setupTest(t)
+	config.Set("enphase.status.enabled", false)
+	config.Set("enphase.meters.enabled", false)
+	config.Set("enphase.inverterDetails.enabled", true)
+	envoy := newTestEnvoy(t, newFakeEnvoy(t, nil).URL, newFakeEnlighten(t, nil).URL)
+
+	if result := loadEnphaseDataAndWriteItToInfluxDB(envoy); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	var details []string
+	for _, line := range influx.lines() {
+		if strings.HasPrefix(line, "inverter_details,") {
+			details = append(details, line)
+		}
+	}
+	assertLines(t, details, []string{
+		`inverter_details,inverter=482212345601,serial=122012345678,site=home acFrequency=60.01,acVoltage=241.25,active=true,commLevel=5i,convErrorSeconds=0,dcCurrent=6.92,dcVoltage=38.21,temperature=31,wattsMax=295,wattsNow=257,whLifetime=614755 1699999950000000000`,
+		`inverter_details,inverter=482212345602,serial=122012345678,site=home acFrequency=60.01,acVoltage=241.5,active=true,commLevel=4i,convErrorSeconds=2,dcCurrent=6.9,dcVoltage=37.95,temperature=32,wattsMax=293,wattsNow=255,whLifetime=612780 1699999980000000000`,
+	})
+}
+
+func TestLoadEnphaseDataExpiredToken(t *testing.T) {
+	influx := setupTest(t)
+	config.Set("enphase.status.enabled", false)
+	config.Set("enphase.meters.enabled", false)
+	stateMutex.Lock()
+	state.envoyStateFor(testEnvoySerial).JWT = JWTToken{Token: "t1.expired-token", ExpiresAt: int(time.Now().Add(-time.Hour).Unix())}
+	stateMutex.Unlock()
+	envoy := newTestEnvoy(t, newFakeEnvoy(t, nil).URL, newFakeEnlighten(t, nil).URL)
+
+	if result := loadEnphaseDataAndWriteItToInfluxDB(envoy); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if envoy.token != fakeEnlightenToken(t) {
+		t.Errorf("polled with token %q, want a new one from Enlighten", envoy.token)
+	}
+	if len(influx.lines()) == 0 {
+		t.Error("no points written")
+	}
+}
+
+func TestLoadEnphaseDataTokenRejected(t *testing.T) {
+	influx := setupTest(t)
+	config.Set("enphase.status.enabled", false)
+	config.Set("enphase.meters.enabled", false)
+	revoked := JWTToken{Token: "t1.revoked-token", ExpiresAt: int(time.Now().Add(30 * 24 * time.Hour).Unix())}
+	stateMutex.Lock()
+	state.envoyStateFor(testEnvoySerial).JWT = revoked
+	stateMutex.Unlock()
+	envoy := newTestEnvoy(t, newFakeEnvoy(t, nil).URL, newFakeEnlighten(t, nil).URL)
+
+	result := loadEnphaseDataAndWriteItToInfluxDB(envoy)
+	if result.Err == nil {
+		t.Fatal("poll with a rejected token succeeded")
+	}
+	if envoy.token != "" {
+		t.Errorf("rejected token %q kept", envoy.token)
+	}
+
+	result = loadEnphaseDataAndWriteItToInfluxDB(envoy)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if envoy.token != fakeEnlightenToken(t) {
+		t.Errorf("polled with token %q, want a new one from Enlighten", envoy.token)
+	}
+	if len(influx.lines()) == 0 {
+		t.Error("no points written after fetching a new token")
+	}
+	stateMutex.Lock()
+	stored := state.envoyStateFor(testEnvoySerial).JWT.Token
+	stateMutex.Unlock()
+	if stored != fakeEnlightenToken(t) {
+		t.Errorf("state keeps token %q", stored)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// envoyMeter is one CT as configured in /ivp/meters
+type envoyMeter struct {
+	EID             int64  `json:"eid"`
+	State           string `json:"state"`
+	MeasurementType string `json:"measurementType"`
+	PhaseMode       string `json:"phaseMode"`
+	PhaseCount      int    `json:"phaseCount"`
+	MeteringStatus  string `json:"meteringStatus"`
+}
+
+// meterValues are the readings of a meter, or of one of its channels (phases)
+type meterValues struct {
+	EID                 int64   `json:"eid"`
+	Timestamp           int64   `json:"timestamp"`
+	ActEnergyDlvd       float64 `json:"actEnergyDlvd"`
+	ActEnergyRcvd       float64 `json:"actEnergyRcvd"`
+	ApparentEnergy      float64 `json:"apparentEnergy"`
+	ReactEnergyLagg     float64 `json:"reactEnergyLagg"`
+	ReactEnergyLead     float64 `json:"reactEnergyLead"`
+	InstantaneousDemand float64 `json:"instantaneousDemand"`
+	ActivePower         float64 `json:"activePower"`
+	ApparentPower       float64 `json:"apparentPower"`
+	ReactivePower       float64 `json:"reactivePower"`
+	PwrFactor           float64 `json:"pwrFactor"`
+	Voltage             float64 `json:"voltage"`
+	Current             float64 `json:"current"`
+	Freq                float64 `json:"freq"`
+}
+
+// meterReading is one entry of /ivp/meters/readings
+type meterReading struct {
+	meterValues
+	Channels []meterValues `json:"channels"`
+}
+
+func decodeMeters(body []byte) ([]envoyMeter, error) {
+	var meters []envoyMeter
+	return meters, json.Unmarshal(body, &meters)
+}
+
+func decodeMeterReadings(body []byte) ([]meterReading, error) {
+	var readings []meterReading
+	return readings, json.Unmarshal(body, &readings)
+}
+
+// loadMeterReadings returns the readings of every CT. The meter configuration
+// rarely changes, it is loaded again only when a reading comes from a meter
+// we don't know.
+func loadMeterReadings(envoy *envoyClient) ([]meterReading, error) {
+	if envoy.meters == nil {
+		if err := loadMeters(envoy); err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := envoy.getBody("/ivp/meters/readings", "meter_readings")
+	if err != nil {
+		return nil, err
+	}
+	readings, err := decodeMeterReadings(body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, reading := range readings {
+		if _, known := envoy.meters[reading.EID]; !known {
+			err = loadMeters(envoy)
+			break
+		}
+	}
+	return readings, err
+}
+
+func loadMeters(envoy *envoyClient) error {
+	body, err := envoy.getBody("/ivp/meters", "meters")
+	if err != nil {
+		return err
+	}
+	meters, err := decodeMeters(body)
+	if err != nil {
+		return err
+	}
+	envoy.setMeters(meters)
+	return nil
+}
+
+func (e *envoyClient) setMeters(meters []envoyMeter) {
+	e.meters = map[int64]envoyMeter{}
+	for _, meter := range meters {
+		e.meters[meter.EID] = meter
+	}
+}
+
+// time is when the Envoy took the reading, channels sometimes carry no
+// timestamp of their own
+func (values meterValues) time(fallback time.Time) time.Time {
+	if values.Timestamp == 0 {
+		return fallback
+	}
+	return time.Unix(values.Timestamp, 0)
+}
+
+func (values meterValues) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"actEnergyDlvd":       values.ActEnergyDlvd,
+		"actEnergyRcvd":       values.ActEnergyRcvd,
+		"apparentEnergy":      values.ApparentEnergy,
+		"reactEnergyLagg":     values.ReactEnergyLagg,
+		"reactEnergyLead":     values.ReactEnergyLead,
+		"instantaneousDemand": values.InstantaneousDemand,
+		"activePower":         values.ActivePower,
+		"apparentPower":       values.ApparentPower,
+		"reactivePower":       values.ReactivePower,
+		"pwrFactor":           values.PwrFactor,
+		"voltage":             values.Voltage,
+		"current":             values.Current,
+		"freq":                values.Freq,
+	}
+}
+
+// writeMeterReadings writes one meters point per CT with channel "total" and
+// one per channel with channel 1, 2, ... at the time the Envoy took the
+// reading, moved by shift when replaying. It returns the number of failed writes.
+func writeMeterReadings(envoy *envoyClient, readings []meterReading, shift time.Duration) int {
+	writeErrors := 0
+
+	for _, reading := range readings {
+		meter := envoy.meters[reading.EID]
+		tags := map[string]string{
+			"serial":          envoy.serial,
+			"site":            envoy.name,
+			"eid":             strconv.FormatInt(reading.EID, 10),
+			"measurementType": meter.MeasurementType,
+			"phaseMode":       meter.PhaseMode,
+			"state":           meter.State,
+			"channel":         "total",
+		}
+		readingTime := reading.time(time.Now())
+		if writeToInfluxDB(influxDBcnx, "meters", tags, reading.fields(), readingTime.Add(shift)) != nil {
+			writeErrors++
+		}
+
+		for i, channel := range reading.Channels {
+			channelTags := make(map[string]string, len(tags)+1)
+			for key, value := range tags {
+				channelTags[key] = value
+			}
+			channelTags["channel"] = strconv.Itoa(i + 1)
+			channelTags["channelEID"] = strconv.FormatInt(channel.EID, 10)
+			if writeToInfluxDB(influxDBcnx, "meters", channelTags, channel.fields(), channel.time(readingTime).Add(shift)) != nil {
+				writeErrors++
+			}
+		}
+
+		envoy.logger.WithFields(log.Fields{"eid": reading.EID, "measurementType": meter.MeasurementType, "activePower": reading.ActivePower, "channels": len(reading.Channels)}).Debugln("Meter reading")
+	}
+
+	return writeErrors
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+// schemaMigration rewrites the series written with the previous schema
+// version into version
+type schemaMigration struct {
+	version     int
+	description string
+	run         func(c influxclient.Client) error
+}
+
+var migrations = []schemaMigration{
+	{
+		version:     2,
+		description: "production and inverter watts as floats, Envoy points tagged with their site, inverters with their full serial, Sense totals with their scale",
+		run: func(c influxclient.Client) error {
+			envoys := configuredEnvoys()
+			serials, err := inverterSerials(envoys)
+			if err != nil {
+				return err
+			}
+			tagSite := siteTagger(envoys)
+			for _, measurement := range []string{"production", "consumption"} {
+				if err := rewriteMeasurement(c, measurement, tagSite); err != nil {
+					return err
+				}
+			}
+			// Sense totals were only polled for the day before sense.scales
+			if err := rewriteMeasurement(c, "sense", func(tags map[string]string) {
+				if tags["scale"] == "" {
+					tags["scale"] = "DAY"
+				}
+			}); err != nil {
+				return err
+			}
+			return rewriteMeasurement(c, "inverters", func(tags map[string]string) {
+				tagSite(tags)
+				suffix := tags["inverter"]
+				if len(suffix) != 5 {
+					return
+				}
+				if serial, ok := serials[suffix]; ok {
+					tags["inverter"] = serial
+					return
+				}
+				splunkLogger.WithField("inverter", suffix).Warnln("No inverter with this serial suffix on the Envoys, keeping it")
+			})
+		},
+	},
+}
+
+// influxStatement runs one InfluxQL statement against the configured database
+func influxStatement(c influxclient.Client, command string) (*influxclient.Response, error) {
+	response, err := c.Query(influxclient.NewQuery(command, config.String("influxdb.db"), "ns"))
+	if err != nil {
+		return nil, err
+	}
+	return response, response.Error()
+}
+
+// siteTagger adds the site tag version 1 didn't write, from the name of the
+// Envoy with the serial of the point
+func siteTagger(envoys []*envoyClient) func(tags map[string]string) {
+	names := map[string]string{}
+	for _, envoy := range envoys {
+		names[envoy.serial] = envoy.name
+	}
+	return func(tags map[string]string) {
+		if tags["site"] != "" {
+			return
+		}
+		tags["site"] = tags["serial"]
+		if name, ok := names[tags["serial"]]; ok {
+			tags["site"] = name
+		}
+	}
+}
+
+// legacySeries is the InfluxQL condition matching the series version 1 wrote
+// to a measurement: those of the configured Envoys, or Sense monitor. A
+// database shared with other tools may hold series of theirs under the same
+// names, those are left alone. It is empty when nothing can be ours.
+func legacySeries(measurement string) string {
+	var conditions []string
+	if measurement == "sense" {
+		if monitorID := config.String("sense.monitorID"); monitorID != "" {
+			conditions = append(conditions, fmt.Sprintf(`"senseMonitorID" = '%s'`, influxQLString(monitorID)))
+		}
+	} else {
+		for _, envoy := range configuredEnvoys() {
+			conditions = append(conditions, fmt.Sprintf(`"serial" = '%s'`, influxQLString(envoy.serial)))
+		}
+	}
+	return strings.Join(conditions, " OR ")
+}
+
+func influxQLString(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
+
+// influxSchemaVersion returns the schema version recorded in the database.
+// A database with version 1 series of the collector but no version is on
+// version 1, one without on 0.
+func influxSchemaVersion(c influxclient.Client) (int, error) {
+	response, err := influxStatement(c, fmt.Sprintf(`SELECT last("version") FROM %q`, measurementName("collector_schema")))
+	if err != nil {
+		return 0, err
+	}
+	for _, result := range response.Results {
+		for _, row := range result.Series {
+			for _, values := range row.Values {
+				if number, ok := values[1].(json.Number); ok {
+					version, err := number.Int64()
+					return int(version), err
+				}
+			}
+		}
+	}
+
+	// Version 1 predates measurement renaming, its production was always
+	// written to "production"
+	condition := legacySeries("production")
+	if condition == "" {
+		return 0, nil
+	}
+	response, err = influxStatement(c, fmt.Sprintf(`SHOW SERIES FROM "production" WHERE %s LIMIT 1`, condition))
+	if err != nil {
+		return 0, err
+	}
+	for _, result := range response.Results {
+		for _, row := range result.Series {
+			if len(row.Values) > 0 {
+				return 1, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+func writeSchemaVersion(c influxclient.Client, version int) error {
+	return writeToInfluxDB(c, "collector_schema", map[string]string{}, map[string]interface{}{"version": version}, time.Now())
+}
+
+// checkSchemaVersion records the schema version in a new database, and
+// refuses to poll into one written by an older version: InfluxDB refuses
+// fields changing type, those writes would fail until it is migrated
+func checkSchemaVersion(c influxclient.Client) {
+	version, err := influxSchemaVersion(c)
+	if err != nil {
+		splunkLogger.WithFields(log.Fields{"Error": "Error reading the schema version from InfluxDB"}).Warn(err)
+		return
+	}
+	switch {
+	case version == 0:
+		if err := writeSchemaVersion(c, schemaVersion); err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Error writing the schema version to InfluxDB"}).Warn(err)
+		}
+	case version < schemaVersion:
+		splunkLogger.WithFields(log.Fields{"schemaVersion": version, "expectedSchemaVersion": schemaVersion}).Fatalln("InfluxDB holds data written with an older schema, run the migrate command before starting the collector")
+	case version > schemaVersion:
+		splunkLogger.WithFields(log.Fields{"schemaVersion": version, "expectedSchemaVersion": schemaVersion}).Warnln("InfluxDB holds data written with a newer schema")
+	}
+}
+
+// runMigrateCommand brings the database up to schemaVersion. The collector
+// must not be writing while it runs.
+func runMigrateCommand() {
+	c := initInfluxDB()
+	version, err := influxSchemaVersion(c)
+	if err != nil {
+		splunkLogger.WithFields(log.Fields{"Error": "Error reading the schema version from InfluxDB"}).Fatalln(err)
+	}
+	splunkLogger.WithFields(log.Fields{"schemaVersion": version, "targetSchemaVersion": schemaVersion}).Infoln("Migrating InfluxDB")
+
+	for _, migration := range migrations {
+		if version == 0 || migration.version <= version {
+			continue
+		}
+		splunkLogger.WithFields(log.Fields{"schemaVersion": migration.version, "migration": migration.description}).Infoln("Running migration")
+		if err := migration.run(c); err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Migration failed", "schemaVersion": migration.version}).Fatalln(err)
+		}
+		if err := writeSchemaVersion(c, migration.version); err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Error writing the schema version to InfluxDB"}).Fatalln(err)
+		}
+		version = migration.version
+	}
+	if version == 0 {
+		if err := writeSchemaVersion(c, schemaVersion); err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Error writing the schema version to InfluxDB"}).Fatalln(err)
+		}
+	}
+	splunkLogger.WithField("schemaVersion", schemaVersion).Infoln("InfluxDB is up to date")
+}
+
+// inverterSerials maps the last 5 digits of the serial of every inverter of
+// the Envoys to the full serial
+func inverterSerials(envoys []*envoyClient) (map[string]string, error) {
+	serials := map[string]string{}
+	for _, envoy := range envoys {
+		if envoy.baseURL == "" && !envoy.rediscover() {
+			return nil, fmt.Errorf("no EnvoyHost configured and Envoy %s not discovered", envoy.serial)
+		}
+		envoy.detectAuth()
+		if err := envoy.ensureToken(); err != nil {
+			return nil, err
+		}
+		inverters, err := loadInverterData(envoy)
+		if err != nil {
+			return nil, err
+		}
+		for _, inverter := range inverters {
+			serial := inverter.Serialnumber
+			if len(serial) < 5 {
+				continue
+			}
+			suffix := serial[len(serial)-5:]
+			if other, ok := serials[suffix]; ok && other != serial {
+				splunkLogger.WithFields(log.Fields{"inverter": serial, "otherInverter": other}).Warnln("Two inverters end with the same 5 digits")
+			}
+			serials[suffix] = serial
+		}
+	}
+	return serials, nil
+}
+
+// rewriteMeasurement rewrites the version 1 series of a measurement through
+// the schema, and retag when given: InfluxDB can't change the type of a
+// field in place, so points are written to a scratch measurement, the
+// original series are dropped and the scratch ones copied to the measurement
+// as it is named now. Version 1 predates renaming, its series are read from
+// the schema name.
+func rewriteMeasurement(c influxclient.Client, measurement string, retag func(tags map[string]string)) error {
+	condition := legacySeries(measurement)
+	if condition == "" {
+		return nil
+	}
+	name := measurementName(measurement)
+	scratch := name + "_migrate"
+	db := config.String("influxdb.db")
+
+	types, err := fieldTypes(c, measurement)
+	if err != nil {
+		return err
+	}
+
+	query := influxclient.NewQuery(fmt.Sprintf(`SELECT * FROM %q WHERE %s GROUP BY *`, measurement, condition), db, "ns")
+	query.ChunkSize = 10000
+	chunks, err := c.QueryAsChunk(query)
+	if err != nil {
+		return err
+	}
+	defer chunks.Close()
+
+	newBatch := func() (influxclient.BatchPoints, error) {
+		return influxclient.NewBatchPoints(influxclient.BatchPointsConfig{Database: db})
+	}
+	batch, err := newBatch()
+	if err != nil {
+		return err
+	}
+	rewritten := 0
+	flush := func() error {
+		if len(batch.Points()) == 0 {
+			return nil
+		}
+		if err := c.Write(batch); err != nil {
+			return err
+		}
+		rewritten += len(batch.Points())
+		var err error
+		batch, err = newBatch()
+		return err
+	}
+
+	for {
+		response, err := chunks.NextResponse()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := response.Error(); err != nil {
+			return err
+		}
+		for _, result := range response.Results {
+			for _, row := range result.Series {
+				tags := map[string]string{}
+				for key, value := range row.Tags {
+					if value != "" {
+						tags[key] = value
+					}
+				}
+				if retag != nil {
+					retag(tags)
+				}
+				for _, values := range row.Values {
+					nanoseconds, err := values[0].(json.Number).Int64()
+					if err != nil {
+						return err
+					}
+					fields := map[string]interface{}{}
+					for i, column := range row.Columns[1:] {
+						switch value := values[i+1].(type) {
+						case nil:
+						case json.Number:
+							fields[column] = storedNumber(value, types[column])
+						default:
+							fields[column] = value
+						}
+					}
+					point, err := influxclient.NewPoint(scratch, tags, conformFields(measurement, fields), time.Unix(0, nanoseconds))
+					if err != nil {
+						return err
+					}
+					batch.AddPoint(point)
+					if len(batch.Points()) >= 5000 {
+						if err := flush(); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	splunkLogger.WithFields(log.Fields{"point": measurement, "points": rewritten}).Infoln("Rewrote measurement")
+	if rewritten == 0 {
+		return nil
+	}
+
+	if _, err := influxStatement(c, fmt.Sprintf(`DROP SERIES FROM %q WHERE %s`, measurement, condition)); err != nil {
+		return err
+	}
+	if _, err := influxStatement(c, fmt.Sprintf(`SELECT * INTO %q FROM %q GROUP BY *`, name, scratch)); err != nil {
+		return fmt.Errorf("copying %s back from %s, the points are still there: %w", name, scratch, err)
+	}
+	_, err = influxStatement(c, fmt.Sprintf(`DROP MEASUREMENT %q`, scratch))
+	return err
+}
+
+// fieldTypes returns the type InfluxDB stores every field of a measurement
+// as. A field written as an integer in some shards and a float in others is
+// a float.
+func fieldTypes(c influxclient.Client, measurement string) (map[string]string, error) {
+	response, err := influxStatement(c, fmt.Sprintf(`SHOW FIELD KEYS FROM %q`, measurement))
+	if err != nil {
+		return nil, err
+	}
+	types := map[string]string{}
+	for _, result := range response.Results {
+		for _, row := range result.Series {
+			for _, values := range row.Values {
+				if len(values) < 2 {
+					continue
+				}
+				field, fieldType := fmt.Sprint(values[0]), fmt.Sprint(values[1])
+				if types[field] != "float" {
+					types[field] = fieldType
+				}
+			}
+		}
+	}
+	return types, nil
+}
+
+// storedNumber turns a number read back from InfluxDB into the type it is
+// stored as, the client would write a json.Number as a string
+func storedNumber(number json.Number, fieldType string) interface{} {
+	if fieldType == "integer" {
+		if value, err := number.Int64(); err == nil {
+			return value
+		}
+	}
+	if value, err := number.Float64(); err == nil {
+		return value
+	}
+	return number.String()
+}
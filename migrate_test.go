@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+
+	"github.com/gookit/config/v2"
+)
+
+// newFakeInfluxServer answers InfluxQL statements with the JSON of
+// answers, an empty result otherwise, and records the statements run and
+// the lines written
+func newFakeInfluxServer(t *testing.T, answers map[string]string) (influxclient.Client, func() ([]string, []string)) {
+	t.Helper()
+	var mutex sync.Mutex
+	var statements, lines []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch r.URL.Path {
+		case "/write":
+			body, _ := io.ReadAll(r.Body)
+			lines = append(lines, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			statement := r.FormValue("q")
+			statements = append(statements, statement)
+			w.Header().Set("Content-Type", "application/json")
+			if answer, ok := answers[statement]; ok {
+				w.Write([]byte(`{"results":[{"statement_id":0,"series":[` + answer + `]}]}` + "\n"))
+				return
+			}
+			w.Write([]byte(`{"results":[{"statement_id":0}]}` + "\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	c, err := influxclient.NewHTTPClient(influxclient.HTTPConfig{Addr: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() ([]string, []string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), statements...), append([]string(nil), lines...)
+	}
+}
+
+func TestRewriteVersion1Production(t *testing.T) {
+	setupTest(t)
+	newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+	config.Set("influxdb.measurementPrefix", "solar_")
+	c, recorded := newFakeInfluxServer(t, map[string]string{
+		`SHOW SERIES FROM "production" WHERE "serial" = '122012345678' LIMIT 1`: `{"columns":["key"],"values":[["production,serial=122012345678,type=inverters"]]}`,
+		`SHOW FIELD KEYS FROM "production"`: `{"name":"production","columns":["fieldKey","fieldType"],"values":[["WNow","integer"],["WhLastSevenDays","float"],["WhToday","float"],["activeInverterCounts","integer"],["alarmCount","integer"],["panelTemp","float"],["whLifetime","integer"]]}`,
+		`SELECT * FROM "production" WHERE "serial" = '122012345678' GROUP BY *`: `{"name":"production","tags":{"serial":"122012345678","type":"inverters"},"columns":["time","WNow","WhLastSevenDays","WhToday","activeInverterCounts","alarmCount","panelTemp","whLifetime"],"values":[[1700000000000000000,512,0,0,2,3,38,1234567]]}`,
+	})
+
+	if version, err := influxSchemaVersion(c); err != nil || version != 1 {
+		t.Fatalf("schema version %d, %v, want 1", version, err)
+	}
+	if err := rewriteMeasurement(c, "production", siteTagger(configuredEnvoys())); err != nil {
+		t.Fatal(err)
+	}
+	if err := rewriteMeasurement(c, "sense", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	statements, lines := recorded()
+	assertLines(t, lines, []string{
+		`solar_production_migrate,serial=122012345678,site=home,type=inverters WNow=512,WhLastSevenDays=0,WhToday=0,activeInverterCounts=2i,alarmCount=3i,panelTemp=38,whLifetime=1234567 1700000000000000000`,
+	})
+	assertLines(t, statements[len(statements)-3:], []string{
+		`DROP SERIES FROM "production" WHERE "serial" = '122012345678'`,
+		`SELECT * INTO "solar_production" FROM "solar_production_migrate" GROUP BY *`,
+		`DROP MEASUREMENT "solar_production_migrate"`,
+	})
+	for _, statement := range statements {
+		if strings.Contains(statement, "sense") {
+			t.Errorf("Sense rewritten without a monitor: %s", statement)
+		}
+	}
+}
+
+func TestSchemaVersionIgnoresOtherTools(t *testing.T) {
+	setupTest(t)
+	newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+	config.Set("influxdb.measurementPrefix", "solar_")
+	// Another tool writes "production", none of its series has our serial
+	c, _ := newFakeInfluxServer(t, nil)
+
+	if version, err := influxSchemaVersion(c); err != nil || version != 0 {
+		t.Errorf("schema version %d, %v, want 0", version, err)
+	}
+}
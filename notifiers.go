@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+type alertNotification struct {
+	Alert  activeAlert `json:"alert"`
+	Status string      `json:"status"`
+	Time   time.Time   `json:"time"`
+}
+
+func (n alertNotification) title() string {
+	if n.Status == "resolved" {
+		return "[RESOLVED] " + n.Alert.Rule
+	}
+	return "[FIRING] " + n.Alert.Rule
+}
+
+// notifier delivers alert notifications somewhere a human will see them
+type notifier interface {
+	name() string
+	notify(n alertNotification) error
+}
+
+var notifierHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// configuredNotifiers returns a notifier for every section of notifiers.* in
+// config that has its address filled in
+func configuredNotifiers() []notifier {
+	var notifiers []notifier
+
+	if url := config.String("notifiers.webhook.url"); url != "" {
+		notifiers = append(notifiers, webhookNotifier{url: url})
+	}
+	if host := config.String("notifiers.smtp.host"); host != "" {
+		notifiers = append(notifiers, smtpNotifier{
+			addr:     fmt.Sprintf("%s:%d", host, config.Int("notifiers.smtp.port", 587)),
+			host:     host,
+			username: config.String("notifiers.smtp.username"),
+			password: secret("notifiers.smtp.password"),
+			from:     config.String("notifiers.smtp.from"),
+			to:       config.Strings("notifiers.smtp.to"),
+		})
+	}
+	if url := config.String("notifiers.ntfy.url"); url != "" {
+		notifiers = append(notifiers, ntfyNotifier{url: url, token: secret("notifiers.ntfy.token")})
+	}
+	if url := config.String("notifiers.gotify.url"); url != "" {
+		notifiers = append(notifiers, gotifyNotifier{url: url, token: secret("notifiers.gotify.token")})
+	}
+
+	return notifiers
+}
+
+var (
+	notificationQueue     chan alertNotification
+	notificationQueueOnce sync.Once
+)
+
+// queueNotifications hands notifications to the one worker sending them, so
+// they go out in order: a resolve never overtakes the firing it resolves
+func queueNotifications(notifications []alertNotification) {
+	notificationQueueOnce.Do(func() {
+		notificationQueue = make(chan alertNotification, 1000)
+		go func() {
+			for n := range notificationQueue {
+				sendNotification(n)
+			}
+		}()
+	})
+	for _, n := range notifications {
+		notificationQueue <- n
+	}
+}
+
+func sendNotification(n alertNotification) {
+	for _, notifier := range configuredNotifiers() {
+		if err := notifier.notify(n); err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Error sending alert notification", "notifier": notifier.name(), "key": n.Alert.Key}).Error(err)
+		}
+	}
+}
+
+func doNotifierRequest(req *http.Request) error {
+	res, err := notifierHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", req.URL.Host, res.Status)
+	}
+	return nil
+}
+
+// webhookNotifier POSTs the notification as JSON
+type webhookNotifier struct {
+	url string
+}
+
+func (webhookNotifier) name() string { return "webhook" }
+
+func (w webhookNotifier) notify(n alertNotification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doNotifierRequest(req)
+}
+
+type smtpNotifier struct {
+	addr, host, username, password, from string
+	to                                   []string
+}
+
+func (smtpNotifier) name() string { return "smtp" }
+
+func (s smtpNotifier) notify(n alertNotification) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+
+	message := "From: " + s.from + "\r\n" +
+		"To: " + strings.Join(s.to, ", ") + "\r\n" +
+		"Subject: " + n.title() + "\r\n" +
+		"Date: " + n.Time.Format(time.RFC1123Z) + "\r\n" +
+		"\r\n" +
+		n.Alert.Summary + "\r\n\r\nSince: " + n.Alert.Since.Format(time.RFC1123) + "\r\n"
+
+	return smtp.SendMail(s.addr, auth, s.from, s.to, []byte(message))
+}
+
+// ntfyNotifier publishes to an ntfy topic URL, e.g. https://ntfy.sh/my-solar
+type ntfyNotifier struct {
+	url, token string
+}
+
+func (ntfyNotifier) name() string { return "ntfy" }
+
+func (nt ntfyNotifier) notify(n alertNotification) error {
+	req, err := http.NewRequest("POST", nt.url, strings.NewReader(n.Alert.Summary))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", n.title())
+	if n.Status == "resolved" {
+		req.Header.Set("Tags", "white_check_mark")
+	} else {
+		req.Header.Set("Tags", "warning")
+		req.Header.Set("Priority", "high")
+	}
+	if nt.token != "" {
+		req.Header.Set("Authorization", "Bearer "+nt.token)
+	}
+	return doNotifierRequest(req)
+}
+
+// gotifyNotifier posts to a Gotify server's /message endpoint with an app token
+type gotifyNotifier struct {
+	url, token string
+}
+
+func (gotifyNotifier) name() string { return "gotify" }
+
+func (g gotifyNotifier) notify(n alertNotification) error {
+	priority := 8
+	if n.Status == "resolved" {
+		priority = 4
+	}
+	body, err := json.Marshal(map[string]interface{}{"title": n.title(), "message": n.Alert.Summary, "priority": priority})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(g.url, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", g.token)
+	return doNotifierRequest(req)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ensembleRelay is the part of /ivp/ensemble/relay we use. The IQ System
+// Controller opens the mains relay when the grid goes away and the site
+// runs islanded on its batteries.
+type ensembleRelay struct {
+	MainsAdminState string `json:"mains_admin_state"`
+	MainsOperState  string `json:"mains_oper_state"`
+}
+
+// ensembleSecctrl is the part of /ivp/ensemble/secctrl we use
+type ensembleSecctrl struct {
+	AggSoc float64 `json:"agg_soc"`
+}
+
+// outageState is an outage in progress, kept in the state file so one
+// spanning a restart of the collector is still recorded
+type outageState struct {
+	Start    time.Time `json:"start"`
+	StartSoC float64   `json:"startSoC"`
+	// StartWh is the total consumption lifetime counter when the outage
+	// started, 0 without consumption CT. ServedWh integrates WNow instead.
+	StartWh  float64   `json:"startWh"`
+	ServedWh float64   `json:"servedWh"`
+	LastPoll time.Time `json:"lastPoll"`
+}
+
+func (relay ensembleRelay) gridOn() bool {
+	return !strings.EqualFold(relay.MainsOperState, "open")
+}
+
+func loadEnsembleRelay(envoy *envoyClient) (ensembleRelay, error) {
+	relay := ensembleRelay{}
+	body, err := envoy.getBody("/ivp/ensemble/relay", "relay")
+	if err != nil {
+		return relay, err
+	}
+	return relay, json.Unmarshal(body, &relay)
+}
+
+func loadStateOfCharge(envoy *envoyClient) (float64, error) {
+	secctrl := ensembleSecctrl{}
+	body, err := envoy.getBody("/ivp/ensemble/secctrl", "secctrl")
+	if err != nil {
+		return 0, err
+	}
+	return secctrl.AggSoc, json.Unmarshal(body, &secctrl)
+}
+
+// totalConsumption returns the total consumption lifetime counter and power
+func totalConsumption(metrics *enphaseMetrics) (whLifetime float64, wNow float64, ok bool) {
+	if metrics == nil {
+		return 0, 0, false
+	}
+	for _, consumption := range metrics.Consumption {
+		if consumption.MeasurementType == "total-consumption" {
+			return consumption.WhLifetime, consumption.WNow, true
+		}
+	}
+	return 0, 0, false
+}
+
+// trackOutages compares the mains relay with what the last poll saw. An
+// outage is logged when it starts, and written to outages when it ends with
+// its duration, the battery state of charge at both ends and the energy the
+// site used while islanded.
+func trackOutages(envoy *envoyClient, result pollResult) int {
+	relay, err := loadEnsembleRelay(envoy)
+	if err != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error loading ensemble relay state"}).Warn(err)
+		return 0
+	}
+	soc, socError := loadStateOfCharge(envoy)
+	if socError != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error loading battery state of charge"}).Warn(socError)
+	}
+	whLifetime, wNow, hasConsumption := totalConsumption(result.Metrics)
+
+	stateMutex.Lock()
+	var outage *outageState
+	if envoyState := state.Envoys[envoy.serial]; envoyState != nil && envoyState.Outage != nil {
+		copied := *envoyState.Outage
+		outage = &copied
+	}
+	stateMutex.Unlock()
+
+	fields := log.Fields{"event": "outage", "mainsOperState": relay.MainsOperState, "soc": soc}
+
+	switch {
+	case !relay.gridOn() && outage == nil:
+		outage = &outageState{Start: result.Time, StartSoC: soc, StartWh: whLifetime, LastPoll: result.Time}
+		envoy.logger.WithFields(fields).WithField("status", "started").Warnln("Grid outage started")
+		saveOutage(envoy, outage)
+	case !relay.gridOn():
+		if hasConsumption {
+			outage.ServedWh += wNow * result.Time.Sub(outage.LastPoll).Hours()
+		}
+		outage.LastPoll = result.Time
+		saveOutage(envoy, outage)
+	case outage != nil:
+		duration := result.Time.Sub(outage.Start)
+		served := outage.ServedWh
+		if hasConsumption && outage.StartWh > 0 && whLifetime >= outage.StartWh {
+			served = whLifetime - outage.StartWh
+		}
+
+		envoy.logger.WithFields(fields).WithFields(log.Fields{
+			"status":          "ended",
+			"start":           outage.Start,
+			"end":             result.Time,
+			"durationSeconds": duration.Seconds(),
+			"startSoC":        outage.StartSoC,
+			"endSoC":          soc,
+			"servedWh":        served,
+		}).Warnln("Grid outage ended")
+		saveOutage(envoy, nil)
+
+		tags := map[string]string{"serial": envoy.serial, "site": envoy.name}
+		outageFields := map[string]interface{}{
+			"end":             result.Time.Unix(),
+			"durationSeconds": duration.Seconds(),
+			"startSoC":        outage.StartSoC,
+			"endSoC":          soc,
+			"servedWh":        served,
+		}
+		if writeToInfluxDB(influxDBcnx, "outages", tags, outageFields, outage.Start) != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+func saveOutage(envoy *envoyClient, outage *outageState) {
+	writeStateError := updateState(func(s *collectorState) { s.envoyStateFor(envoy.serial).Outage = outage })
+	if writeStateError != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error saving outage state"}).Error(writeStateError)
+	}
+}
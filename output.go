@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/gookit/config/v2"
+)
+
+// measurementName is the name a measurement is written under: its entry in
+// influxdb.measurements when there is one, influxdb.measurementPrefix
+// followed by the schema name otherwise
+func measurementName(name string) string {
+	if renamed := config.String("influxdb.measurements." + name); renamed != "" {
+		return renamed
+	}
+	return config.String("influxdb.measurementPrefix") + name
+}
+
+// withStaticTags adds the influxdb.tags of the config to the tags of a
+// point. Static tags win, a configured site replaces the Envoy name.
+func withStaticTags(tags map[string]string) map[string]string {
+	static := config.StringMap("influxdb.tags")
+	if len(static) == 0 {
+		return tags
+	}
+	merged := make(map[string]string, len(tags)+len(static))
+	for key, value := range tags {
+		merged[key] = value
+	}
+	for key, value := range static {
+		merged[key] = value
+	}
+	return merged
+}
+
+// selectFields keeps the fields influxdb.fields.include lists for the
+// measurement, or for "*", when there is such a list, and drops those
+// influxdb.fields.exclude lists. Measurements are named as in the schema.
+func selectFields(measurement string, fields map[string]interface{}) map[string]interface{} {
+	include := fieldSet("influxdb.fields.include", measurement)
+	exclude := fieldSet("influxdb.fields.exclude", measurement)
+	if include == nil && exclude == nil {
+		return fields
+	}
+
+	selected := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		if include != nil && !include[name] {
+			continue
+		}
+		if exclude[name] {
+			continue
+		}
+		selected[name] = value
+	}
+	return selected
+}
+
+func fieldSet(key string, measurement string) map[string]bool {
+	names := append(config.Strings(key+"."+measurement), config.Strings(key+".*")...)
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gookit/config/v2"
+)
+
+func TestStaticTagsWin(t *testing.T) {
+	influx := setupTest(t)
+	config.Set("influxdb.tags", map[string]interface{}{"site": "cabin", "owner": "facilities"})
+
+	tags := map[string]string{"serial": testEnvoySerial, "site": "home", "type": "eim"}
+	if err := writeToInfluxDB(influx, "production", tags, map[string]interface{}{"wNow": 512.5}, time.Unix(1700000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertLines(t, influx.lines(), []string{
+		`production,owner=facilities,serial=122012345678,site=cabin,type=eim wNow=512.5 1700000000000000000`,
+	})
+	if tags["site"] != "home" {
+		t.Errorf("tags of the point changed to %v", tags)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+// pqSample is what one poll saw on one phase. Frequency is 0 when only
+// production.json was available, it doesn't report any. nominalPhases is
+// the number of nominal phase voltages voltage amounts to: 2 for the total of
+// a split-phase meter, 0 when that isn't known and voltage can't be checked.
+type pqSample struct {
+	phase         string
+	voltage       float64
+	frequency     float64
+	powerFactor   float64
+	nominalPhases float64
+}
+
+// pqStats accumulates min/max/avg of one quantity over a window
+type pqStats struct {
+	min, max, sum float64
+	count         int
+}
+
+func (s *pqStats) add(value float64) {
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || value > s.max {
+		s.max = value
+	}
+	s.sum += value
+	s.count++
+}
+
+func (s *pqStats) addFields(fields map[string]interface{}, name string) {
+	if s.count == 0 {
+		return
+	}
+	fields[name+"Min"] = s.min
+	fields[name+"Max"] = s.max
+	fields[name+"Avg"] = s.sum / float64(s.count)
+}
+
+// pqWindow aggregates the samples of every phase over one window length
+type pqWindow struct {
+	length time.Duration
+	start  time.Time
+	phases map[string]*[3]pqStats // voltage, frequency, power factor
+}
+
+// pqEvent is a sag, swell or frequency excursion in progress, kept in the
+// state file so one spanning a restart of the collector is still recorded
+type pqEvent struct {
+	Start   time.Time `json:"start"`
+	Extreme float64   `json:"extreme"`
+}
+
+// powerQualityTracker is kept per Envoy between polls. eventsChanged tells
+// the events have to be saved to state.
+type powerQualityTracker struct {
+	windows       []*pqWindow
+	events        map[string]*pqEvent
+	eventsChanged bool
+}
+
+func newPowerQualityTracker(serial string) *powerQualityTracker {
+	tracker := &powerQualityTracker{events: map[string]*pqEvent{}}
+
+	stateMutex.Lock()
+	if envoyState := state.Envoys[serial]; envoyState != nil {
+		for key, event := range envoyState.PowerQualityEvents {
+			event := event
+			tracker.events[key] = &event
+		}
+	}
+	stateMutex.Unlock()
+
+	minutes := config.Ints("powerQuality.windowsMinutes")
+	if len(minutes) == 0 {
+		minutes = []int{15}
+	}
+	for _, m := range minutes {
+		if m > 0 {
+			tracker.windows = append(tracker.windows, &pqWindow{length: time.Duration(m) * time.Minute})
+		}
+	}
+	return tracker
+}
+
+// powerQualitySamples takes the per phase readings of the grid side meter
+// (net or total consumption), the production meter when there is none, and
+// falls back to the lines of the production.json eim entry without meters
+func powerQualitySamples(result pollResult) []pqSample {
+	var grid, production *meterReading
+	for i, reading := range result.Meters {
+		switch result.Envoy.meters[reading.EID].MeasurementType {
+		case "net-consumption", "total-consumption":
+			if grid == nil {
+				grid = &result.Meters[i]
+			}
+		case "production":
+			production = &result.Meters[i]
+		}
+	}
+	if grid == nil {
+		grid = production
+	}
+
+	var samples []pqSample
+	if grid != nil {
+		if len(grid.Channels) == 0 {
+			return []pqSample{{"total", grid.Voltage, grid.Freq, grid.PwrFactor, totalNominalPhases(result.Envoy.meters[grid.EID])}}
+		}
+		for i, channel := range grid.Channels {
+			frequency := channel.Freq
+			if frequency == 0 {
+				frequency = grid.Freq
+			}
+			samples = append(samples, pqSample{"L" + strconv.Itoa(i+1), channel.Voltage, frequency, channel.PwrFactor, 1})
+		}
+		return samples
+	}
+
+	if result.Metrics == nil {
+		return nil
+	}
+	for _, production := range result.Metrics.Production {
+		if production.Type != "eim" {
+			continue
+		}
+		for i, line := range production.Lines {
+			samples = append(samples, pqSample{"L" + strconv.Itoa(i+1), line.RmsVoltage, 0, line.PwrFactor, 1})
+		}
+	}
+	return samples
+}
+
+// totalNominalPhases is what the voltage of a meter without channels is
+// measured across: the whole 240V of a split-phase service, one phase of a
+// single phase one. Three phase totals aren't compared with anything.
+func totalNominalPhases(meter envoyMeter) float64 {
+	switch {
+	case meter.PhaseMode == "split":
+		return 2
+	case meter.PhaseCount <= 1 && meter.PhaseMode != "three":
+		return 1
+	}
+	return 0
+}
+
+// trackPowerQuality feeds the samples of one poll to the windows and the event
+// detection. Events have the resolution of the polling period.
+func trackPowerQuality(result pollResult) int {
+	if !config.Bool("powerQuality.enabled") || result.Envoy == nil {
+		return 0
+	}
+	samples := powerQualitySamples(result)
+	if len(samples) == 0 {
+		return 0
+	}
+
+	envoy := result.Envoy
+	if envoy.powerQuality == nil {
+		envoy.powerQuality = newPowerQualityTracker(envoy.serial)
+	}
+	tracker := envoy.powerQuality
+	writeErrors := 0
+
+	for _, window := range tracker.windows {
+		if window.phases != nil && result.Time.Sub(window.start) >= window.length {
+			writeErrors += writePowerQualityWindow(envoy, window)
+			window.phases = nil
+		}
+		if window.phases == nil {
+			window.start = result.Time
+			window.phases = map[string]*[3]pqStats{}
+		}
+		for _, sample := range samples {
+			stats := window.phases[sample.phase]
+			if stats == nil {
+				stats = &[3]pqStats{}
+				window.phases[sample.phase] = stats
+			}
+			stats[0].add(sample.voltage)
+			if sample.frequency != 0 {
+				stats[1].add(sample.frequency)
+			}
+			stats[2].add(sample.powerFactor)
+		}
+	}
+
+	for _, sample := range samples {
+		for eventType, value := range powerQualityExcursions(sample) {
+			writeErrors += tracker.updateEvent(envoy, eventType, sample.phase, value, result.Time)
+		}
+	}
+	if tracker.eventsChanged {
+		tracker.saveEvents(envoy)
+	}
+
+	return writeErrors
+}
+
+func (tracker *powerQualityTracker) saveEvents(envoy *envoyClient) {
+	events := make(map[string]pqEvent, len(tracker.events))
+	for key, event := range tracker.events {
+		events[key] = *event
+	}
+	writeStateError := updateState(func(s *collectorState) { s.envoyStateFor(envoy.serial).PowerQualityEvents = events })
+	if writeStateError != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error saving power quality events"}).Error(writeStateError)
+		return
+	}
+	tracker.eventsChanged = false
+}
+
+// powerQualityExcursions returns, for every event type that can happen on
+// this sample, the value when it is out of bounds and NaN when it is not
+func powerQualityExcursions(sample pqSample) map[string]float64 {
+	nominalVoltage := config.Float("powerQuality.nominalVoltage", 120)
+	nominalFrequency := config.Float("powerQuality.nominalFrequency", 60)
+	sagPercent := config.Float("powerQuality.sagPercent", 10)
+	swellPercent := config.Float("powerQuality.swellPercent", 10)
+	frequencyTolerance := config.Float("powerQuality.frequencyToleranceHz", 0.5)
+
+	outside := func(out bool, value float64) float64 {
+		if out {
+			return value
+		}
+		return math.NaN()
+	}
+
+	excursions := map[string]float64{}
+	if sample.nominalPhases != 0 {
+		nominal := nominalVoltage * sample.nominalPhases
+		excursions["sag"] = outside(sample.voltage < nominal*(1-sagPercent/100), sample.voltage)
+		excursions["swell"] = outside(sample.voltage > nominal*(1+swellPercent/100), sample.voltage)
+	}
+	if sample.frequency != 0 {
+		excursions["under_frequency"] = outside(sample.frequency < nominalFrequency-frequencyTolerance, sample.frequency)
+		excursions["over_frequency"] = outside(sample.frequency > nominalFrequency+frequencyTolerance, sample.frequency)
+	}
+	return excursions
+}
+
+// updateEvent starts, extends or ends an event. An event is written to
+// pq_events once it ends, at its start time with its duration and the most
+// extreme value seen.
+func (tracker *powerQualityTracker) updateEvent(envoy *envoyClient, eventType string, phase string, value float64, now time.Time) int {
+	key := eventType + "/" + phase
+	event := tracker.events[key]
+	fields := log.Fields{"event": "pq_event", "type": eventType, "phase": phase}
+
+	switch {
+	case !math.IsNaN(value) && event == nil:
+		tracker.events[key] = &pqEvent{Start: now, Extreme: value}
+		tracker.eventsChanged = true
+		envoy.logger.WithFields(fields).WithFields(log.Fields{"status": "started", "value": value}).Warnln("Power quality event started")
+	case !math.IsNaN(value):
+		if (eventType == "sag" || eventType == "under_frequency") == (value < event.Extreme) {
+			event.Extreme = value
+			tracker.eventsChanged = true
+		}
+	case event != nil:
+		delete(tracker.events, key)
+		tracker.eventsChanged = true
+		duration := now.Sub(event.Start)
+		envoy.logger.WithFields(fields).WithFields(log.Fields{"status": "ended", "extreme": event.Extreme, "durationSeconds": duration.Seconds()}).Warnln("Power quality event ended")
+
+		tags := map[string]string{"serial": envoy.serial, "site": envoy.name, "type": eventType, "phase": phase}
+		eventFields := map[string]interface{}{"durationSeconds": duration.Seconds(), "extreme": event.Extreme}
+		if writeToInfluxDB(influxDBcnx, "pq_events", tags, eventFields, event.Start) != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+func writePowerQualityWindow(envoy *envoyClient, window *pqWindow) int {
+	writeErrors := 0
+	for phase, stats := range window.phases {
+		fields := map[string]interface{}{}
+		stats[0].addFields(fields, "voltage")
+		stats[1].addFields(fields, "frequency")
+		stats[2].addFields(fields, "powerFactor")
+		fields["samples"] = stats[0].count
+
+		tags := map[string]string{"serial": envoy.serial, "site": envoy.name, "phase": phase, "window": fmt.Sprintf("%dm", int(window.length.Minutes()))}
+		if writeToInfluxDB(influxDBcnx, "power_quality", tags, fields, window.start) != nil {
+			writeErrors++
+		}
+	}
+	return writeErrors
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gookit/config/v2"
+)
+
+func totalOnlyPoll(envoy *envoyClient, at time.Time, voltage float64) pollResult {
+	envoy.meters = map[int64]envoyMeter{704643584: {EID: 704643584, MeasurementType: "net-consumption", PhaseMode: "split", PhaseCount: 2}}
+	return pollResult{
+		Envoy:  envoy,
+		Time:   at,
+		Meters: []meterReading{{meterValues: meterValues{EID: 704643584, Voltage: voltage, Freq: 60.01, PwrFactor: 0.92}}},
+	}
+}
+
+func TestPowerQualitySplitPhaseTotal(t *testing.T) {
+	setupTest(t)
+	config.Set("powerQuality.enabled", true)
+	envoy := newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+
+	trackPowerQuality(totalOnlyPoll(envoy, time.Now(), 241.5))
+	if len(envoy.powerQuality.events) != 0 {
+		t.Errorf("events on a normal split-phase total: %v", envoy.powerQuality.events)
+	}
+}
+
+func TestPowerQualityEventAcrossRestart(t *testing.T) {
+	influx := setupTest(t)
+	config.Set("powerQuality.enabled", true)
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	envoy := newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+	trackPowerQuality(totalOnlyPoll(envoy, start, 201.5))
+	trackPowerQuality(totalOnlyPoll(envoy, start.Add(5*time.Minute), 198.25))
+
+	// The collector restarts during the sag
+	envoy = newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+	trackPowerQuality(totalOnlyPoll(envoy, start.Add(15*time.Minute), 240.75))
+
+	var events []string
+	for _, line := range influx.lines() {
+		if strings.HasPrefix(line, "pq_events,") {
+			events = append(events, line)
+		}
+	}
+	assertLines(t, events, []string{
+		`pq_events,phase=total,serial=122012345678,site=home,type=sag durationSeconds=900,extreme=198.25 1717243200000000000`,
+	})
+
+	stateMutex.Lock()
+	inProgress := len(state.envoyStateFor(testEnvoySerial).PowerQualityEvents)
+	stateMutex.Unlock()
+	if inProgress != 0 {
+		t.Errorf("%d events still in progress in state", inProgress)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	recordDir   = flag.String("record", "", "save every raw Envoy and Sense response into this directory")
+	replayDir   = flag.String("replay", "", "write the responses recorded in this directory to InfluxDB instead of polling")
+	replaySpeed = flag.Float64("replay-speed", 0, "replay at this multiple of the original pace, 0 replays as fast as possible")
+	replayShift = flag.Duration("replay-shift", 0, "move replayed timestamps by this duration, e.g. 720h")
+	replayToNow = flag.Bool("replay-to-now", false, "shift replayed timestamps so the first recording lands now")
+)
+
+// Recordings are named <time>_<source>[_<serial>].json, e.g.
+// 20240612T143000.123Z_production_122012345678.json. Sense responses and
+// recordings made before several Envoys were supported have no serial.
+const recordingTimeLayout = "20060102T150405.000Z0700"
+
+// replayers feed a recorded body through the same decode and write path as a
+// live poll. recordedAt is when the response was recorded, shift how much
+// timestamps have to be moved. envoy is the configured Envoy the recording
+// was made on.
+var replayers = map[string]func(envoy *envoyClient, body []byte, recordedAt time.Time, shift time.Duration){
+	"production": func(envoy *envoyClient, body []byte, recordedAt time.Time, shift time.Duration) {
+		if enphaseData, err := decodeProductionDetailsData(body); err == nil {
+			validations := validateProductionData(envoy, enphaseData, recordedAt.Add(shift))
+			writeProductionData(envoy, enphaseData, validations, recordedAt.Add(shift), log.Fields{})
+		}
+	},
+	"inverters": func(envoy *envoyClient, body []byte, recordedAt time.Time, shift time.Duration) {
+		if invertersData, err := decodeInverterData(body); err == nil {
+			writeInverterData(envoy, invertersData, shift, log.Fields{})
+		}
+	},
+	"device_data": func(envoy *envoyClient, body []byte, recordedAt time.Time, shift time.Duration) {
+		if devices, err := decodeDeviceData(body); err == nil {
+			writeInverterDetails(envoy, devices, nil, shift)
+		}
+	},
+	"events": func(envoy *envoyClient, body []byte, recordedAt time.Time, shift time.Duration) {
+		if events, err := decodeEnvoyEvents(body); err == nil {
+			writeEnvoyEvents(envoy, events, recordedAt, shift)
+		}
+	},
+	"meters": func(envoy *envoyClient, body []byte, recordedAt time.Time, shift time.Duration) {
+		if meters, err := decodeMeters(body); err == nil {
+			envoy.setMeters(meters)
+		}
+	},
+	"meter_readings": func(envoy *envoyClient, body []byte, recordedAt time.Time, shift time.Duration) {
+		if readings, err := decodeMeterReadings(body); err == nil {
+			writeMeterReadings(envoy, readings, shift)
+		}
+	},
+	"sense": func(envoy *envoyClient, body []byte, recordedAt time.Time, shift time.Duration) {
+		if senseData := decodeSenseData(body); senseData != nil {
+			writeSenseDataToInfluxDB(*senseData, recordedAt.Add(shift))
+		}
+	},
+}
+
+// recordResponse saves a raw response body when running with --record
+func recordResponse(source string, serial string, body []byte) {
+	if *recordDir == "" {
+		return
+	}
+
+	name := time.Now().UTC().Format(recordingTimeLayout) + "_" + source
+	if serial != "" {
+		name += "_" + serial
+	}
+	name += ".json"
+	err := os.WriteFile(filepath.Join(*recordDir, name), body, 0600)
+	if err != nil {
+		splunkLogger.WithFields(log.Fields{"Error": "Error recording response", "source": source, "recordDir": *recordDir}).Error(err)
+	}
+}
+
+type recording struct {
+	path       string
+	source     string
+	serial     string
+	recordedAt time.Time
+}
+
+func listRecordings(dir string) ([]recording, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var recordings []recording
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		timestamp, source, found := strings.Cut(name, "_")
+		// Sources may contain underscores, serials don't
+		serial := ""
+		if i := strings.LastIndex(source, "_"); replayers[source] == nil && i >= 0 {
+			source, serial = source[:i], source[i+1:]
+		}
+		if entry.IsDir() || !found || replayers[source] == nil {
+			continue
+		}
+		recordedAt, err := time.Parse(recordingTimeLayout, timestamp)
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, recording{filepath.Join(dir, entry.Name()), source, serial, recordedAt})
+	}
+
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].recordedAt.Before(recordings[j].recordedAt) })
+
+	return recordings, nil
+}
+
+// replayRecordings writes everything recorded in --replay to InfluxDB, in
+// order, pacing itself according to --replay-speed
+func replayRecordings() {
+	recordings, err := listRecordings(*replayDir)
+	if err != nil {
+		splunkLogger.WithFields(log.Fields{"Error": "Error listing recordings", "replayDir": *replayDir}).Fatalln(err)
+	}
+	if len(recordings) == 0 {
+		splunkLogger.WithField("replayDir", *replayDir).Warnln("No recordings to replay")
+		return
+	}
+
+	shift := *replayShift
+	if *replayToNow {
+		shift = time.Since(recordings[0].recordedAt)
+	}
+
+	envoys := map[string]*envoyClient{}
+	configured := configuredEnvoys()
+	for _, envoy := range configured {
+		envoys[envoy.serial] = envoy
+	}
+
+	splunkLogger.WithFields(log.Fields{"replayDir": *replayDir, "recordings": len(recordings), "speed": *replaySpeed, "shift": shift.String()}).Infoln("Replaying recordings")
+
+	for i, rec := range recordings {
+		if i > 0 && *replaySpeed > 0 {
+			gap := rec.recordedAt.Sub(recordings[i-1].recordedAt)
+			time.Sleep(time.Duration(float64(gap) / *replaySpeed))
+		}
+
+		body, err := os.ReadFile(rec.path)
+		if err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Error reading recording", "file": rec.path}).Error(err)
+			continue
+		}
+
+		// Recordings without a serial belong to the first Envoy
+		envoy := configured[0]
+		if rec.serial != "" {
+			envoy = envoys[rec.serial]
+			if envoy == nil {
+				splunkLogger.WithFields(log.Fields{"file": rec.path, "serial": rec.serial}).Warnln("Skipping recording of an Envoy that isn't configured")
+				continue
+			}
+		}
+
+		splunkLogger.WithFields(log.Fields{"file": rec.path, "source": rec.source}).Debugln("Replaying recording")
+		replayers[rec.source](envoy, body, rec.recordedAt, shift)
+	}
+
+	splunkLogger.WithField("recordings", len(recordings)).Infoln("Replay finished")
+}
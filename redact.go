@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// Field names whose values are never logged, matched case-insensitively
+// against the end of the field name so "senseToken" is masked but
+// "JWT_Expiration" is not
+var secretFieldPattern = regexp.MustCompile(`(?i)(password|passwd|secret|token|jwt|cookies?|authorization|api[_-]?key)$`)
+
+var secretValuePatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// Authorization: Bearer xxx
+	{regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-._~+/]+=*`), "${1}" + redacted},
+	// Anything that looks like a JWT, even outside of a header
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`), redacted},
+	// Cookie and Set-Cookie headers, as printed by http.Header or on the wire
+	{regexp.MustCompile(`(?i)((?:set-)?cookie["']?\s*[:=]\s*\[?)[^\]\r\n]*`), "${1}" + redacted},
+	// key: value or key=value pairs, as printed by fmt for maps and by url.Values
+	{regexp.MustCompile(`(?i)((?:password|passwd|secret|token|jwt|access_token|api[_-]?key)\w*\]?["']?\s*[:=]\s*["']?)[^\s,&\[\]{}"']+`), "${1}" + redacted},
+}
+
+var (
+	knownSecrets      = map[string]struct{}{}
+	knownSecretsMutex sync.RWMutex
+)
+
+// registerSecret records a value, such as a password or token, that must be
+// masked wherever it shows up in a log entry
+func registerSecret(value string) {
+	// Very short values would mask half of every log line
+	if len(value) < 4 {
+		return
+	}
+	knownSecretsMutex.Lock()
+	knownSecrets[value] = struct{}{}
+	knownSecretsMutex.Unlock()
+}
+
+// redactString masks known secrets, bearer tokens, JWTs and cookies in s
+func redactString(s string) string {
+	knownSecretsMutex.RLock()
+	for value := range knownSecrets {
+		s = strings.ReplaceAll(s, value, redacted)
+	}
+	knownSecretsMutex.RUnlock()
+
+	for _, p := range secretValuePatterns {
+		s = p.pattern.ReplaceAllString(s, p.replacement)
+	}
+	return s
+}
+
+// redactValue returns a log field value that is safe to format. Numbers and
+// booleans go through untouched, everything else is turned into a string
+// first so secrets hidden in structs (http.Response, config maps) are caught.
+func redactValue(key string, value interface{}) interface{} {
+	if secretFieldPattern.MatchString(key) {
+		return redacted
+	}
+
+	switch v := value.(type) {
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case string:
+		return redactString(v)
+	case error:
+		return redactString(v.Error())
+	case []byte:
+		return redactString(string(v))
+	default:
+		return redactString(fmt.Sprint(v))
+	}
+}
+
+// redactHook scrubs every entry before it is formatted or handed to any
+// other hook. It has to be the first hook added to the logger.
+type redactHook struct{}
+
+func (redactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (redactHook) Fire(entry *log.Entry) error {
+	entry.Message = redactString(entry.Message)
+
+	for key, value := range entry.Data {
+		entry.Data[key] = redactValue(key, value)
+	}
+
+	return nil
+}
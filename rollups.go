@@ -0,0 +1,297 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+// rollupPeriods are the rollups kept, with the scale of startOfPeriod they
+// follow and the measurement they are written to when they close
+var rollupPeriods = []struct {
+	name        string
+	scale       string
+	measurement string
+}{
+	{"day", "DAY", "daily_energy"},
+	{"month", "MONTH", "monthly_energy"},
+	{"year", "YEAR", "yearly_energy"},
+}
+
+// rollupQuantities are the energies rolled up, in Wh
+var rollupQuantities = []string{"produced", "consumed", "imported", "exported"}
+
+// rollupPeriod is a day, month or year in progress
+type rollupPeriod struct {
+	Start  time.Time          `json:"start"`
+	Energy map[string]float64 `json:"energy"`
+	PeakW  float64            `json:"peakW"`
+	// PeakTime is when production peaked
+	PeakTime time.Time `json:"peakTime"`
+	// GapSeconds is how much of the period wasn't seen, polls too far
+	// apart or the collector not running yet when it started
+	GapSeconds float64 `json:"gapSeconds"`
+}
+
+// rollupState is kept in the state file, so the periods in progress go on
+// over restarts and the ones that ended while the collector was stopped
+// are closed on the first poll after
+type rollupState struct {
+	LastPoll time.Time `json:"lastPoll"`
+	// Counters are the lifetime energy counters at the last poll
+	Counters map[string]float64       `json:"counters"`
+	Periods  map[string]*rollupPeriod `json:"periods"`
+}
+
+// rollupSample is what one poll says about the quantities. Counters are
+// lifetime counters, today the Envoy's own counters of the day, power in W.
+type rollupSample struct {
+	time     time.Time
+	counters map[string]float64
+	today    map[string]float64
+	power    map[string]float64
+}
+
+// rollupSampleOf takes production from the production CT when there is one
+// and from the microinverters otherwise, consumption from the total
+// consumption CT, and imports and exports from the net consumption meter
+// counters, or the net power
+func rollupSampleOf(result pollResult) rollupSample {
+	sample := rollupSample{time: result.Time, counters: map[string]float64{}, today: map[string]float64{}, power: map[string]float64{}}
+
+	var production *Production
+	for i, data := range result.Metrics.Production {
+		if data.Type == "eim" && data.ActiveCount > 0 || data.Type == "inverters" && production == nil {
+			production = &result.Metrics.Production[i]
+		}
+	}
+	if production != nil {
+		sample.counters["produced"] = production.WhLifetime
+		sample.power["produced"] = math.Max(production.WNow, 0)
+		if production.Type == "eim" {
+			sample.today["produced"] = production.WhToday
+		}
+	}
+
+	net, hasNet := 0.0, false
+	for _, data := range result.Metrics.Consumption {
+		switch data.MeasurementType {
+		case "total-consumption":
+			sample.counters["consumed"] = data.WhLifetime
+			sample.today["consumed"] = data.WhToday
+			sample.power["consumed"] = math.Max(data.WNow, 0)
+		case "net-consumption":
+			net, hasNet = data.WNow, true
+		}
+	}
+	if !hasNet {
+		if consumed, ok := sample.power["consumed"]; ok {
+			net, hasNet = consumed-sample.power["produced"], true
+		}
+	}
+	if hasNet {
+		sample.power["imported"] = math.Max(net, 0)
+		sample.power["exported"] = math.Max(-net, 0)
+	}
+
+	for _, reading := range result.Meters {
+		if result.Envoy.meters[reading.EID].MeasurementType == "net-consumption" {
+			sample.counters["imported"] = reading.ActEnergyDlvd
+			sample.counters["exported"] = reading.ActEnergyRcvd
+		}
+	}
+	return sample
+}
+
+// rollupDeltas is the energy of every quantity since the last poll, from the
+// lifetime counters when they moved plausibly and by integrating the power
+// otherwise. Nothing is integrated over a gap, the power of one poll says
+// nothing of what happened for that long.
+func rollupDeltas(envoy *envoyClient, rollup *rollupState, sample rollupSample, metrics enphaseMetrics) (map[string]float64, bool) {
+	elapsed := sample.time.Sub(rollup.LastPoll)
+	gap := elapsed > time.Duration(config.Int("rollups.maxGapMinutes", 15))*time.Minute
+
+	productionCapacity, consumptionCapacity := envoy.capacities(metrics)
+	capacities := map[string]float64{"produced": productionCapacity, "exported": productionCapacity, "consumed": consumptionCapacity, "imported": consumptionCapacity}
+
+	deltas := map[string]float64{}
+	for _, quantity := range rollupQuantities {
+		now, hasNow := sample.counters[quantity]
+		last, hasLast := rollup.Counters[quantity]
+		capacity := capacities[quantity]
+		if capacity == 0 {
+			capacity = math.Inf(1)
+		}
+		if hasNow && hasLast && now >= last && now-last <= capacity*elapsed.Hours()+capacity/60 {
+			deltas[quantity] = now - last
+			continue
+		}
+		if power, ok := sample.power[quantity]; ok && !gap {
+			deltas[quantity] = power * elapsed.Hours()
+		}
+	}
+	return deltas, gap
+}
+
+// trackRollups adds what happened since the last poll to the day, month
+// and year in progress, and closes those that ended, see closeRollupPeriods.
+func trackRollups(envoy *envoyClient, result pollResult) int {
+	if result.Metrics == nil {
+		return 0
+	}
+	sample := rollupSampleOf(result)
+
+	stateMutex.Lock()
+	rollup := rollupState{}
+	if envoyState := state.Envoys[envoy.serial]; envoyState != nil && envoyState.Rollup != nil {
+		rollup = copyRollupState(*envoyState.Rollup)
+	}
+	stateMutex.Unlock()
+	if rollup.Periods == nil {
+		rollup.Periods = map[string]*rollupPeriod{}
+	}
+
+	deltas := map[string]float64{}
+	gap := true
+	if !rollup.LastPoll.IsZero() && sample.time.After(rollup.LastPoll) {
+		deltas, gap = rollupDeltas(envoy, &rollup, sample, *result.Metrics)
+	}
+
+	writeErrors := 0
+	for _, kind := range rollupPeriods {
+		start := startOfPeriod(sample.time, kind.scale)
+		period := rollup.Periods[kind.name]
+
+		switch {
+		case period == nil:
+			// Started before the collector first saw it
+			period = &rollupPeriod{Start: start, Energy: map[string]float64{}, GapSeconds: sample.time.Sub(start).Seconds()}
+		case period.Start.Equal(start):
+			for quantity, delta := range deltas {
+				period.Energy[quantity] += delta
+			}
+			if gap && !rollup.LastPoll.IsZero() {
+				period.GapSeconds += sample.time.Sub(rollup.LastPoll).Seconds()
+			}
+		default:
+			var closeErrors int
+			period, closeErrors = closeRollupPeriods(envoy, kind.scale, kind.measurement, period, start, rollup.LastPoll, sample, deltas, gap)
+			writeErrors += closeErrors
+		}
+
+		if produced := sample.power["produced"]; produced > period.PeakW {
+			period.PeakW, period.PeakTime = produced, sample.time
+		}
+		rollup.Periods[kind.name] = period
+	}
+
+	rollup.LastPoll = sample.time
+	rollup.Counters = sample.counters
+	writeStateError := updateState(func(s *collectorState) { s.envoyStateFor(envoy.serial).Rollup = &rollup })
+	if writeStateError != nil {
+		envoy.logger.WithFields(log.Fields{"Error": "Error saving rollups to state"}).Error(writeStateError)
+	}
+	return writeErrors
+}
+
+// closeRollupPeriods closes the period that was in progress at the last
+// poll, and every one that went by entirely since, which are incomplete, and
+// returns the period starting at start. The energy since the last poll goes
+// to the new period from the Envoy's today counters when it started at
+// midnight today, in proportion to time otherwise, and the rest is shared
+// among the closed periods in proportion to the time each had since the last
+// poll.
+func closeRollupPeriods(envoy *envoyClient, scale string, measurement string, period *rollupPeriod, start time.Time, lastPoll time.Time, sample rollupSample, deltas map[string]float64, gap bool) (*rollupPeriod, int) {
+	elapsed := sample.time.Sub(lastPoll).Seconds()
+	endedSeconds := math.Max(start.Sub(lastPoll).Seconds(), 0)
+	startedToday := start.Equal(startOfDay(sample.time))
+
+	current := &rollupPeriod{Start: start, Energy: map[string]float64{}}
+	remaining := map[string]float64{}
+	for quantity, delta := range deltas {
+		current.Energy[quantity] = delta * (elapsed - endedSeconds) / elapsed
+		if today, ok := sample.today[quantity]; ok && today >= 0 && startedToday {
+			current.Energy[quantity] = math.Min(today, delta)
+		}
+		remaining[quantity] = delta - current.Energy[quantity]
+	}
+	if gap {
+		current.GapSeconds = sample.time.Sub(start).Seconds()
+	}
+
+	writeErrors := 0
+	for {
+		end := endOfPeriod(period.Start, scale)
+		if end.After(start) {
+			end = start
+		}
+		seen := lastPoll
+		if seen.Before(period.Start) {
+			// Went by entirely without a poll
+			seen = period.Start
+			period.GapSeconds = end.Sub(period.Start).Seconds()
+		} else if gap {
+			period.GapSeconds += end.Sub(seen).Seconds()
+		}
+		if endedSeconds > 0 {
+			for quantity, energy := range remaining {
+				period.Energy[quantity] += energy * math.Max(end.Sub(seen).Seconds(), 0) / endedSeconds
+			}
+		}
+		writeErrors += writeRollup(envoy, measurement, period, end)
+
+		if !end.Before(start) {
+			return current, writeErrors
+		}
+		period = &rollupPeriod{Start: end, Energy: map[string]float64{}}
+	}
+}
+
+// copyRollupState copies the state so it can be worked on without holding
+// stateMutex
+func copyRollupState(rollup rollupState) rollupState {
+	copied := rollupState{LastPoll: rollup.LastPoll, Counters: rollup.Counters, Periods: map[string]*rollupPeriod{}}
+	for name, period := range rollup.Periods {
+		periodCopy := *period
+		periodCopy.Energy = make(map[string]float64, len(period.Energy))
+		for quantity, energy := range period.Energy {
+			periodCopy.Energy[quantity] = energy
+		}
+		copied.Periods[name] = &periodCopy
+	}
+	return copied
+}
+
+// writeRollup writes a closed period at its start. Self consumption is the
+// production that wasn't exported.
+func writeRollup(envoy *envoyClient, measurement string, period *rollupPeriod, end time.Time) int {
+	// Gaps are counted poll to poll, and can't be longer than the period
+	gapSeconds := math.Min(period.GapSeconds, end.Sub(period.Start).Seconds())
+	fields := map[string]interface{}{
+		"gapSeconds": gapSeconds,
+		"complete":   gapSeconds == 0,
+	}
+	for quantity, energy := range period.Energy {
+		fields[quantity+"Wh"] = energy
+	}
+	produced, hasProduced := period.Energy["produced"]
+	exported, hasExported := period.Energy["exported"]
+	if hasProduced && hasExported {
+		fields["selfConsumedWh"] = math.Max(produced-exported, 0)
+	}
+	if !period.PeakTime.IsZero() {
+		fields["peakW"] = period.PeakW
+		fields["peakTime"] = period.PeakTime.Unix()
+	}
+
+	envoy.logger.WithFields(log.Fields(fields)).WithFields(log.Fields{"event": "rollup", "point": measurement, "start": period.Start, "end": end}).Infoln("Closed energy rollup")
+
+	tags := map[string]string{"serial": envoy.serial, "site": envoy.name}
+	if writeToInfluxDB(influxDBcnx, measurement, tags, fields, period.Start) != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gookit/config/v2"
+)
+
+func rollupPoll(envoy *envoyClient, at string, whLifetime float64, whToday float64, wNow float64) pollResult {
+	t, _ := time.Parse("2006-01-02T15:04:05", at)
+	return pollResult{
+		Envoy:   envoy,
+		Time:    t,
+		Metrics: &enphaseMetrics{Production: []Production{{Type: "eim", ActiveCount: 1, WhLifetime: whLifetime, WhToday: whToday, WNow: wNow}}},
+	}
+}
+
+// rollupPoints returns the fields written to each rollup measurement, by
+// start of the period
+func rollupPoints(influx *fakeInflux) map[string]map[string]map[string]interface{} {
+	points := map[string]map[string]map[string]interface{}{}
+	for _, point := range influx.points {
+		fields, _ := point.Fields()
+		if points[point.Name()] == nil {
+			points[point.Name()] = map[string]map[string]interface{}{}
+		}
+		points[point.Name()][point.Time().UTC().Format("2006-01-02")] = fields
+	}
+	return points
+}
+
+func assertRollup(t *testing.T, points map[string]map[string]map[string]interface{}, measurement string, start string, producedWh float64, gapSeconds float64) {
+	t.Helper()
+	fields, ok := points[measurement][start]
+	if !ok {
+		t.Errorf("no %s point for %s", measurement, start)
+		return
+	}
+	if produced, _ := fields["producedWh"].(float64); math.Abs(produced-producedWh) > 0.01 {
+		t.Errorf("%s %s producedWh %v, want %v", measurement, start, fields["producedWh"], producedWh)
+	}
+	if fields["gapSeconds"] != gapSeconds {
+		t.Errorf("%s %s gapSeconds %v, want %v", measurement, start, fields["gapSeconds"], gapSeconds)
+	}
+	if complete := fields["complete"]; complete != (gapSeconds == 0) {
+		t.Errorf("%s %s complete %v with a gap of %vs", measurement, start, complete, gapSeconds)
+	}
+}
+
+func TestRollupsAcrossMidnight(t *testing.T) {
+	influx := setupTest(t)
+	setSiteLocation(t, "UTC")
+	config.Set("enphase.nameplateWatts", 5000)
+	envoy := newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+
+	trackRollups(envoy, rollupPoll(envoy, "2024-06-14T23:50:00", 10000, 9000, 0))
+	trackRollups(envoy, rollupPoll(envoy, "2024-06-14T23:55:00", 10050, 9050, 0))
+	trackRollups(envoy, rollupPoll(envoy, "2024-06-15T00:05:00", 10150, 30, 0))
+
+	points := rollupPoints(influx)
+	if len(points["daily_energy"]) != 1 || len(points["monthly_energy"]) != 0 {
+		t.Fatalf("points written: %v", points)
+	}
+	// 70Wh of the last 100Wh went to the 14th, the 15th counted 30Wh
+	assertRollup(t, points, "daily_energy", "2024-06-14", 120, 85800)
+
+	stateMutex.Lock()
+	day := state.envoyStateFor(testEnvoySerial).Rollup.Periods["day"]
+	stateMutex.Unlock()
+	if day.Energy["produced"] != 30 || day.GapSeconds != 0 {
+		t.Errorf("the 15th starts with %+v", day)
+	}
+}
+
+func TestRollupsAfterDowntime(t *testing.T) {
+	influx := setupTest(t)
+	setSiteLocation(t, "UTC")
+	config.Set("enphase.nameplateWatts", 5000)
+	envoy := newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+
+	trackRollups(envoy, rollupPoll(envoy, "2024-06-29T20:00:00", 10000, 12000, 1000))
+	// Down from the 29th at 20:00 to July 2nd at 06:00, 58 hours
+	trackRollups(envoy, rollupPoll(envoy, "2024-07-02T06:00:00", 68000, 600, 200))
+
+	points := rollupPoints(influx)
+	if len(points["daily_energy"]) != 3 || len(points["monthly_energy"]) != 1 || len(points["yearly_energy"]) != 0 {
+		t.Fatalf("points written: %v", points)
+	}
+	// July 2nd counted 600Wh, the other 57400Wh are spread over the 52
+	// hours of June 29th, June 30th and July 1st no poll saw
+	assertRollup(t, points, "daily_energy", "2024-06-29", 57400*4.0/52, 86400)
+	assertRollup(t, points, "daily_energy", "2024-06-30", 57400*24.0/52, 86400)
+	assertRollup(t, points, "daily_energy", "2024-07-01", 57400*24.0/52, 86400)
+	if points["daily_energy"]["2024-06-29"]["peakW"] != 1000.0 || points["daily_energy"]["2024-06-30"]["peakW"] != nil {
+		t.Error("peak written to the wrong day")
+	}
+	// July didn't start today, the day counter says nothing of it: 30 of
+	// the 58 hours were in July
+	assertRollup(t, points, "monthly_energy", "2024-06-01", 58000*28.0/58, 30*86400)
+
+	stateMutex.Lock()
+	periods := state.envoyStateFor(testEnvoySerial).Rollup.Periods
+	stateMutex.Unlock()
+	expected := map[string]struct {
+		produced   float64
+		gapSeconds float64
+	}{
+		"day":   {600, 6 * 3600},
+		"month": {58000 * 30.0 / 58, 30 * 3600},
+		"year":  {58000, (31+29+31+30+31+28)*86400 + 20*3600 + 58*3600},
+	}
+	for name, want := range expected {
+		period := periods[name]
+		if math.Abs(period.Energy["produced"]-want.produced) > 0.01 || period.GapSeconds != want.gapSeconds {
+			t.Errorf("%s in progress: %v Wh with %vs gap, want %v Wh with %vs", name, period.Energy["produced"], period.GapSeconds, want.produced, want.gapSeconds)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// schemaVersion is the version of the measurements described by schema.
+// Bump it with every change existing series have to be migrated for, and
+// add the migration to migrations.
+//
+// Version 1 wrote the production whLifetime and WNow and the inverter watts
+// as integers, tagged inverters with the last 5 digits of their serial and,
+// until sense.scales, wrote the Sense totals without a scale tag.
+const schemaVersion = 2
+
+type fieldType string
+
+const (
+	fieldFloat   fieldType = "float"
+	fieldInteger fieldType = "integer"
+	fieldBoolean fieldType = "boolean"
+	fieldString  fieldType = "string"
+)
+
+type fieldSchema struct {
+	Type fieldType
+	Unit string
+}
+
+// measurementSchema describes one measurement. Field names may start or
+// end with * for fields named after a phase, interface, ...
+type measurementSchema struct {
+	Tags   []string
+	Fields map[string]fieldSchema
+}
+
+var (
+	floatField   = func(unit string) fieldSchema { return fieldSchema{fieldFloat, unit} }
+	integerField = func(unit string) fieldSchema { return fieldSchema{fieldInteger, unit} }
+	booleanField = fieldSchema{Type: fieldBoolean}
+	stringField  = fieldSchema{Type: fieldString}
+	envoyTags    = []string{"serial", "site"}
+	validFields  = map[string]fieldSchema{"whLifetimeCorrected": floatField("Wh"), "suspect": booleanField, "suspectReason": stringField}
+)
+
+// schema is every measurement the collector writes. writeToInfluxDB
+// converts fields to the type given here, whatever the code building them
+// used, so a field never changes type.
+var schema = map[string]measurementSchema{
+	"production": {
+		Tags: append(envoyTags, "type"),
+		Fields: withFields(validFields, map[string]fieldSchema{
+			"whLifetime":           floatField("Wh"),
+			"WhLastSevenDays":      floatField("Wh"),
+			"WhToday":              floatField("Wh"),
+			"WNow":                 floatField("W"),
+			"activeInverterCounts": integerField(""),
+			"rmsVoltage":           floatField("V"),
+		}),
+	},
+	"consumption": {
+		Tags: append(envoyTags, "type"),
+		Fields: withFields(validFields, map[string]fieldSchema{
+			"whLifetime":      floatField("Wh"),
+			"WhLastSevenDays": floatField("Wh"),
+			"WhToday":         floatField("Wh"),
+			"rmsVoltage":      floatField("V"),
+		}),
+	},
+	"inverters": {
+		Tags: append(envoyTags, "inverter"),
+		Fields: map[string]fieldSchema{
+			"lastReportWatts": floatField("W"),
+			"maxReportWatts":  floatField("W"),
+		},
+	},
+	"inverter_details": {
+		Tags: append(envoyTags, "inverter"),
+		Fields: map[string]fieldSchema{
+			"wattsNow":         floatField("W"),
+			"wattsMax":         floatField("W"),
+			"whLifetime":       floatField("Wh"),
+			"acVoltage":        floatField("V"),
+			"acFrequency":      floatField("Hz"),
+			"dcVoltage":        floatField("V"),
+			"dcCurrent":        floatField("A"),
+			"temperature":      floatField("°C"),
+			"convErrorSeconds": floatField("s"),
+			"active":           booleanField,
+			"commLevel":        integerField("0-5"),
+		},
+	},
+	"meters": {
+		Tags: append(envoyTags, "eid", "measurementType", "phaseMode", "state", "channel", "channelEID"),
+		Fields: map[string]fieldSchema{
+			"actEnergyDlvd":       floatField("Wh"),
+			"actEnergyRcvd":       floatField("Wh"),
+			"apparentEnergy":      floatField("VAh"),
+			"reactEnergyLagg":     floatField("varh"),
+			"reactEnergyLead":     floatField("varh"),
+			"instantaneousDemand": floatField("W"),
+			"activePower":         floatField("W"),
+			"apparentPower":       floatField("VA"),
+			"reactivePower":       floatField("var"),
+			"pwrFactor":           floatField(""),
+			"voltage":             floatField("V"),
+			"current":             floatField("A"),
+			"freq":                floatField("Hz"),
+		},
+	},
+	"power_quality": {
+		Tags: append(envoyTags, "phase", "window"),
+		Fields: map[string]fieldSchema{
+			"voltage*":     floatField("V"),
+			"frequency*":   floatField("Hz"),
+			"powerFactor*": floatField(""),
+			"samples":      integerField(""),
+		},
+	},
+	"pq_events": {
+		Tags: append(envoyTags, "type", "phase"),
+		Fields: map[string]fieldSchema{
+			"durationSeconds": floatField("s"),
+			"extreme":         floatField("V or Hz"),
+		},
+	},
+	"outages": {
+		Tags: envoyTags,
+		Fields: map[string]fieldSchema{
+			"end":             integerField("Unix s"),
+			"durationSeconds": floatField("s"),
+			"startSoC":        floatField("%"),
+			"endSoC":          floatField("%"),
+			"servedWh":        floatField("Wh"),
+		},
+	},
+	"envoy_status": {
+		Tags: envoyTags,
+		Fields: map[string]fieldSchema{
+			"firmware":                  stringField,
+			"partNumber":                stringField,
+			"imeter":                    booleanField,
+			"webComm":                   booleanField,
+			"primaryInterface":          stringField,
+			"enlightenReportAgeSeconds": integerField("s"),
+			"*Carrier":                  booleanField,
+			"*Signal":                   integerField(""),
+			"*SignalMax":                integerField(""),
+			"commNum":                   integerField(""),
+			"commLevel":                 integerField("0-5"),
+			"*Num":                      integerField(""),
+			"*CommLevel":                integerField("0-5"),
+			"alertCount":                integerField(""),
+			"alerts":                    stringField,
+			"updateStatus":              stringField,
+		},
+	},
+	"envoy_events": {
+		Tags: append(envoyTags, "deviceType"),
+		Fields: map[string]fieldSchema{
+			"eventID": integerField(""),
+			"title":   stringField,
+			"text":    stringField,
+			"tags":    stringField,
+			"device":  stringField,
+		},
+	},
+	"sense": {
+		Tags: []string{"senseMonitorID", "scale"},
+		Fields: map[string]fieldSchema{
+			"Production":    floatField("kWh"),
+			"Consumption":   floatField("kWh"),
+			"ToGrid":        floatField("kWh"),
+			"FromGrid":      floatField("kWh"),
+			"SolarPowered":  integerField("%"),
+			"NetProduction": floatField("kWh"),
+			"ProductionPct": integerField("%"),
+		},
+	},
+	"sense_devices": {
+		Tags: []string{"senseMonitorID", "scale", "direction", "deviceID", "deviceName", "deviceType"},
+		Fields: map[string]fieldSchema{
+			"TotalKwh":  floatField("kWh"),
+			"AvgW":      floatField("W"),
+			"Pct":       floatField("%"),
+			"TotalCost": floatField(""),
+		},
+	},
+	"sense_realtime": {
+		Tags: []string{"senseMonitorID"},
+		Fields: map[string]fieldSchema{
+			"W":        floatField("W"),
+			"SolarW":   floatField("W"),
+			"GridW":    floatField("W"),
+			"Hz":       floatField("Hz"),
+			"Voltage*": floatField("V"),
+		},
+	},
+	"daily_energy":   rollupSchema,
+	"monthly_energy": rollupSchema,
+	"yearly_energy":  rollupSchema,
+	"collector_schema": {
+		Fields: map[string]fieldSchema{"version": integerField("")},
+	},
+	"sense_device": {
+		Tags:   []string{"senseMonitorID", "deviceID", "deviceName"},
+		Fields: map[string]fieldSchema{"W": floatField("W")},
+	},
+}
+
+var rollupSchema = measurementSchema{
+	Tags: envoyTags,
+	Fields: map[string]fieldSchema{
+		"producedWh":     floatField("Wh"),
+		"consumedWh":     floatField("Wh"),
+		"importedWh":     floatField("Wh"),
+		"exportedWh":     floatField("Wh"),
+		"selfConsumedWh": floatField("Wh"),
+		"peakW":          floatField("W"),
+		"peakTime":       integerField("Unix s"),
+		"gapSeconds":     floatField("s"),
+		"complete":       booleanField,
+	},
+}
+
+func withFields(common map[string]fieldSchema, fields map[string]fieldSchema) map[string]fieldSchema {
+	for name, field := range common {
+		fields[name] = field
+	}
+	return fields
+}
+
+// field looks a field up, by name first and then by pattern
+func (m measurementSchema) field(name string) (fieldSchema, bool) {
+	if field, ok := m.Fields[name]; ok {
+		return field, true
+	}
+	for pattern, field := range m.Fields {
+		switch {
+		case strings.HasPrefix(pattern, "*") && strings.HasSuffix(name, pattern[1:]):
+			return field, true
+		case strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, pattern[:len(pattern)-1]):
+			return field, true
+		}
+	}
+	return fieldSchema{}, false
+}
+
+// conformFields returns the fields converted to the types of the schema.
+// Fields it doesn't know are kept as they are.
+func conformFields(measurement string, fields map[string]interface{}) map[string]interface{} {
+	measurementSchema, known := schema[measurement]
+	conformed := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		field, ok := measurementSchema.field(name)
+		if !ok {
+			if known {
+				splunkLogger.WithFields(log.Fields{"point": measurement, "field": name}).Debugln("Field missing from the schema")
+			}
+			conformed[name] = value
+			continue
+		}
+		converted, err := convertField(value, field.Type)
+		if err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Field doesn't match the schema", "point": measurement, "field": name}).Warn(err)
+			continue
+		}
+		conformed[name] = converted
+	}
+	return conformed
+}
+
+func convertField(value interface{}, to fieldType) (interface{}, error) {
+	if to == fieldString {
+		return fmt.Sprint(value), nil
+	}
+
+	var number float64
+	switch v := value.(type) {
+	case float64:
+		number = v
+	case float32:
+		number = float64(v)
+	case int:
+		number = float64(v)
+	case int64:
+		number = float64(v)
+	case int32:
+		number = float64(v)
+	case json.Number:
+		parsed, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		number = parsed
+	case bool:
+		if to == fieldBoolean {
+			return v, nil
+		}
+		if v {
+			number = 1
+		}
+	case string:
+		if to == fieldBoolean {
+			return strconv.ParseBool(v)
+		}
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, err
+		}
+		number = parsed
+	default:
+		return nil, fmt.Errorf("can't convert %T to %s", value, to)
+	}
+
+	switch to {
+	case fieldInteger:
+		return int64(math.Round(number)), nil
+	case fieldBoolean:
+		return number != 0, nil
+	}
+	return number, nil
+}
+
+// printSchema lists the measurements for the schema command
+func printSchema() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "schema version %d\n\n", schemaVersion)
+	fmt.Fprintln(w, "MEASUREMENT\tFIELD\tTYPE\tUNIT\tTAGS")
+
+	measurements := make([]string, 0, len(schema))
+	for name := range schema {
+		measurements = append(measurements, name)
+	}
+	sort.Strings(measurements)
+	for _, measurement := range measurements {
+		fields := make([]string, 0, len(schema[measurement].Fields))
+		for name := range schema[measurement].Fields {
+			fields = append(fields, name)
+		}
+		sort.Strings(fields)
+		for i, name := range fields {
+			tags := ""
+			if i == 0 {
+				tags = strings.Join(schema[measurement].Tags, ",")
+			}
+			field := schema[measurement].Fields[name]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", measurement, name, field.Type, field.Unit, tags)
+		}
+	}
+	w.Flush()
+}
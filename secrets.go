@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+// secretKeys lists the config keys holding credentials, they are resolved
+// when the loggers start so their values can be masked from then on
+var secretKeys = []string{
+	"enphase.EnphasePassword", "influxdb.password", "sense.password",
+	"splunk.token", "loki.password",
+	"notifiers.smtp.password", "notifiers.ntfy.token", "notifiers.gotify.token",
+}
+
+var (
+	resolvedSecrets      = map[string]string{}
+	resolvedSecretsMutex sync.Mutex
+)
+
+// secret resolves a credential so it doesn't have to sit in plain text in
+// config.yaml. For a key such as "influxdb.password" it looks, in order, at:
+//
+//   - the INFLUXDB_PASSWORD environment variable
+//   - the file named by "influxdb.passwordFile" (Docker/Kubernetes secrets)
+//   - the output of the "influxdb.passwordCommand" shell command
+//   - the "influxdb.password" value itself
+//
+// Values are cached once resolved, so commands only run once. A file that
+// can't be read or a command that fails is tried again on the next call: the
+// secret may not be mounted, or the vault agent up, yet.
+func secret(key string) string {
+	resolvedSecretsMutex.Lock()
+	defer resolvedSecretsMutex.Unlock()
+
+	if value, ok := resolvedSecrets[key]; ok {
+		return value
+	}
+
+	value, err := resolveSecret(key)
+	if err != nil {
+		return ""
+	}
+	resolvedSecrets[key] = value
+	registerSecret(value)
+
+	return value
+}
+
+func resolveSecret(key string) (string, error) {
+
+	if value, ok := os.LookupEnv(secretEnvName(key)); ok {
+		return value, nil
+	}
+
+	if path := config.String(key + "File"); path != "" {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Error reading secret file", "key": key, "file": path}).Error(err)
+			return "", err
+		}
+		return strings.TrimRight(string(body), "\r\n"), nil
+	}
+
+	if command := config.String(key + "Command"); command != "" {
+		out, err := exec.Command("sh", "-c", command).Output()
+		if err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Error running secret command", "key": key}).Error(err)
+			return "", err
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+
+	return config.String(key), nil
+}
+
+// secretEnvName maps a config key to its environment variable,
+// "enphase.EnphasePassword" becomes ENPHASE_ENPHASEPASSWORD
+func secretEnvName(key string) string {
+	return strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gookit/config/v2"
+)
+
+func TestSecretRetriesFailedLookups(t *testing.T) {
+	setupTest(t)
+	path := filepath.Join(t.TempDir(), "influxdb-password")
+	config.Set("influxdb.passwordFile", path)
+
+	if value := secret("influxdb.password"); value != "" {
+		t.Fatalf("secret read %q before the file was mounted", value)
+	}
+
+	if err := os.WriteFile(path, []byte(testPassphrase+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if value := secret("influxdb.password"); value != testPassphrase {
+		t.Fatalf("secret %q once the file is mounted, want %q", value, testPassphrase)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if value := secret("influxdb.password"); value != testPassphrase {
+		t.Errorf("secret %q after a successful read, want the cached %q", value, testPassphrase)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+var errSenseUnauthorized = errors.New("sense API rejected the access token")
+
+// senseSession hands out the Sense access token, logging in again when
+// Sense rejects it. Failed logins back off exponentially up to
+// sense.maxBackoffMinutes so a wrong password doesn't hammer the API.
+type senseSession struct {
+	mutex       sync.Mutex
+	token       string
+	failures    int
+	nextAttempt time.Time
+}
+
+var senseAuth = &senseSession{}
+
+// accessToken returns the cached token, the one kept in state or a new one,
+// "" while backing off after a failed login
+func (s *senseSession) accessToken() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token != "" {
+		return s.token
+	}
+
+	stateMutex.Lock()
+	s.token = state.Sense.AccessToken
+	stateMutex.Unlock()
+	if s.token != "" {
+		registerSecret(s.token)
+		return s.token
+	}
+
+	if time.Now().Before(s.nextAttempt) {
+		return ""
+	}
+
+	s.token = authSense()
+	if s.token == "" {
+		s.failures++
+		backoff := time.Minute
+		for i := 1; i < s.failures && i <= 10; i++ {
+			backoff *= 2
+		}
+		if maxBackoff := time.Duration(config.Int("sense.maxBackoffMinutes", 60)) * time.Minute; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		s.nextAttempt = time.Now().Add(backoff)
+		splunkLogger.WithFields(log.Fields{"failures": s.failures, "nextAttempt": s.nextAttempt}).Warnln("Sense login failed, backing off")
+		return ""
+	}
+	s.failures = 0
+
+	writeStateError := updateState(func(st *collectorState) { st.Sense.AccessToken = s.token })
+	if writeStateError != nil {
+		splunkLogger.WithFields(log.Fields{"Error": "Error saving Sense token to state"}).Error(writeStateError)
+	}
+	return s.token
+}
+
+// invalidate drops a token Sense rejected so the next accessToken logs in
+func (s *senseSession) invalidate(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token != token {
+		return
+	}
+	s.token = ""
+	writeStateError := updateState(func(st *collectorState) { st.Sense.AccessToken = "" })
+	if writeStateError != nil {
+		splunkLogger.WithFields(log.Fields{"Error": "Error saving Sense token to state"}).Error(writeStateError)
+	}
+}
+
+// pollSense writes the Sense trends when sense.enabled is set. Nothing that
+// goes wrong here, panics included, gets in the way of Enphase collection.
+func pollSense() {
+	if !config.Bool("sense.enabled") {
+		return
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Sense poll panicked"}).Error(recovered)
+		}
+	}()
+
+	for _, scale := range senseScales() {
+		token := senseAuth.accessToken()
+		if token == "" {
+			splunkLogger.Infoln("No Sense token, not getting Sense data")
+			return
+		}
+
+		senseData, err := loadSenseData(token, scale)
+		if errors.Is(err, errSenseUnauthorized) {
+			splunkLogger.Infoln("Sense token rejected, logging in again")
+			senseAuth.invalidate(token)
+			if token = senseAuth.accessToken(); token == "" {
+				return
+			}
+			senseData, err = loadSenseData(token, scale)
+		}
+		if err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Error loading Sense data", "scale": scale}).Error(err)
+			continue
+		}
+
+		writeSenseDataToInfluxDB(*senseData, time.Now())
+	}
+}
+
+// senseScales are the trends periods polled, sense.scales takes any of DAY,
+// WEEK, MONTH and YEAR
+func senseScales() []string {
+	var scales []string
+	for _, scale := range config.Strings("sense.scales") {
+		scale = strings.ToUpper(scale)
+		switch scale {
+		case "DAY", "WEEK", "MONTH", "YEAR":
+			scales = append(scales, scale)
+		default:
+			splunkLogger.WithField("scale", scale).Warnln("Ignoring unknown Sense scale")
+		}
+	}
+	if len(scales) == 0 {
+		return []string{"DAY"}
+	}
+	return scales
+}
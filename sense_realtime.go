@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+	"golang.org/x/net/websocket"
+)
+
+// senseRealtimeMessage is one message of the Sense monitor realtime feed.
+// Only realtime_update messages carry readings.
+type senseRealtimeMessage struct {
+	Type    string              `json:"type"`
+	Payload senseRealtimeUpdate `json:"payload"`
+}
+
+type senseRealtimeUpdate struct {
+	W       float64   `json:"w"`
+	SolarW  float64   `json:"solar_w"`
+	GridW   float64   `json:"grid_w"`
+	Hz      float64   `json:"hz"`
+	Voltage []float64 `json:"voltage"`
+	Devices []struct {
+		ID   string  `json:"id"`
+		Name string  `json:"name"`
+		W    float64 `json:"w"`
+	} `json:"devices"`
+}
+
+// senseRealtimeURL is the feed of the configured monitor. sense.realtime.url
+// can point at a local stand-in, e.g. ws://localhost:8765
+func senseRealtimeURL(token string) string {
+	base := strings.TrimSuffix(config.String("sense.realtime.url", "wss://clientrt.sense.com"), "/")
+	return fmt.Sprintf("%s/monitors/%s/realtimefeed?access_token=%s", base, config.String("sense.monitorID"), token)
+}
+
+// runSenseRealtime keeps the realtime feed open for as long as the process
+// runs, reconnecting with exponential backoff up to
+// sense.realtime.maxBackoffSeconds
+func runSenseRealtime() {
+	maxBackoff := time.Duration(config.Int("sense.realtime.maxBackoffSeconds", 300)) * time.Second
+	backoff := time.Second
+
+	for {
+		connectedAt := time.Now()
+		err := readSenseRealtime()
+
+		// A feed that stayed up a while was healthy, start over
+		if time.Since(connectedAt) > maxBackoff {
+			backoff = time.Second
+		}
+		splunkLogger.WithFields(log.Fields{"Error": "Sense realtime feed closed", "retryIn": backoff.String()}).Warn(err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// readSenseRealtime reads the feed until it fails, writing one sample every
+// sense.realtime.downsampleSeconds. The feed itself sends about two a second.
+func readSenseRealtime() error {
+	token := senseAuth.accessToken()
+	if token == "" {
+		return errors.New("no Sense token")
+	}
+
+	wsConfig, err := websocket.NewConfig(senseRealtimeURL(token), "https://home.sense.com")
+	if err != nil {
+		return err
+	}
+
+	ws, status, err := dialSenseRealtime(wsConfig)
+	if err != nil {
+		// Sense refuses the upgrade when the token is no longer valid
+		if status == http.StatusUnauthorized || status == http.StatusForbidden {
+			senseAuth.invalidate(token)
+		}
+		return err
+	}
+	defer ws.Close()
+
+	splunkLogger.Infoln("Connected to the Sense realtime feed")
+
+	downsample := time.Duration(config.Int("sense.realtime.downsampleSeconds", 10)) * time.Second
+	readTimeout := time.Duration(config.Int("sense.realtime.readTimeoutSeconds", 60)) * time.Second
+	var lastWrite time.Time
+
+	for {
+		ws.SetReadDeadline(time.Now().Add(readTimeout))
+
+		message := senseRealtimeMessage{}
+		if err := websocket.JSON.Receive(ws, &message); err != nil {
+			return err
+		}
+
+		switch message.Type {
+		case "realtime_update":
+		case "error":
+			return errors.New("sense realtime feed sent an error")
+		default:
+			splunkLogger.WithField("type", message.Type).Debugln("Ignoring Sense realtime message")
+			continue
+		}
+
+		now := time.Now()
+		if now.Sub(lastWrite) < downsample {
+			continue
+		}
+		lastWrite = now
+		writeSenseRealtime(message.Payload, now)
+	}
+}
+
+// handshakeConn keeps the status line of the handshake response: the
+// websocket package only tells it wasn't 101, and a refused token has to be
+// told from Sense being down
+type handshakeConn struct {
+	net.Conn
+	head []byte
+}
+
+func (c *handshakeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if len(c.head) < 128 && !bytes.Contains(c.head, []byte("\r\n")) {
+		c.head = append(c.head, p[:n]...)
+	}
+	return n, err
+}
+
+// statusCode is the status of the handshake response, 0 when none was read
+func (c *handshakeConn) statusCode() int {
+	line, _, _ := bytes.Cut(c.head, []byte("\r\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(fields[1])
+	return code
+}
+
+// dialSenseRealtime opens the feed, and returns the status Sense answered the
+// handshake with when it refused it
+func dialSenseRealtime(wsConfig *websocket.Config) (*websocket.Conn, int, error) {
+	location := wsConfig.Location
+	dialer := &net.Dialer{Timeout: httpTimeout}
+
+	var conn net.Conn
+	var err error
+	switch location.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", hostPort(location.Hostname(), location.Port(), "80"))
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostPort(location.Hostname(), location.Port(), "443"), wsConfig.TlsConfig)
+	default:
+		return nil, 0, websocket.ErrBadScheme
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	handshake := &handshakeConn{Conn: conn}
+	conn.SetDeadline(time.Now().Add(httpTimeout))
+	ws, err := websocket.NewClient(wsConfig, handshake)
+	if err != nil {
+		conn.Close()
+		return nil, handshake.statusCode(), fmt.Errorf("sense realtime handshake: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, 0, nil
+}
+
+func hostPort(host string, port string, defaultPort string) string {
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func writeSenseRealtime(update senseRealtimeUpdate, eventTime time.Time) {
+	tags := map[string]string{"senseMonitorID": config.String("sense.monitorID")}
+
+	fields := map[string]interface{}{
+		"W":      update.W,
+		"SolarW": update.SolarW,
+		"GridW":  update.GridW,
+		"Hz":     update.Hz,
+	}
+	for i, voltage := range update.Voltage {
+		fields[fmt.Sprintf("Voltage%d", i+1)] = voltage
+	}
+	writeToInfluxDB(influxDBcnx, "sense_realtime", tags, fields, eventTime)
+
+	for _, device := range update.Devices {
+		deviceTags := map[string]string{"senseMonitorID": config.String("sense.monitorID"), "deviceID": device.ID, "deviceName": device.Name}
+		writeToInfluxDB(influxDBcnx, "sense_device", deviceTags, map[string]interface{}{"W": device.W}, eventTime)
+	}
+
+	splunkLogger.WithFields(log.Fields{"W": update.W, "SolarW": update.SolarW, "devices": len(update.Devices)}).Debugln("Wrote Sense realtime data to InfluxDB")
+}
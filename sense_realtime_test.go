@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gookit/config/v2"
+	"golang.org/x/net/websocket"
+)
+
+const testSenseToken = "t1.v2.sense-test-access-token"
+
+// newFakeSenseRealtime serves the realtime feed to testSenseToken: one
+// message to ignore, one update, then an error. status refuses the
+// handshake instead when set.
+func newFakeSenseRealtime(t *testing.T, status int) *httptest.Server {
+	t.Helper()
+	feed := websocket.Handler(func(ws *websocket.Conn) {
+		websocket.Message.Send(ws, `{"type":"hello","payload":{"online":true}}`)
+		websocket.Message.Send(ws, `{"type":"realtime_update","payload":{"w":1523.4,"solar_w":2210.5,"grid_w":-687.1,"hz":60.01,"voltage":[121.2,120.8],"devices":[{"id":"a1b2c3","name":"Fridge","w":61.5}]}}`)
+		websocket.Message.Send(ws, `{"type":"error","payload":{}}`)
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		if r.URL.Path != "/monitors/12345/realtimefeed" || r.URL.Query().Get("access_token") != testSenseToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		feed.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestReadSenseRealtime(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		token       string
+		points      int
+		invalidated bool
+	}{
+		{"feed", 0, testSenseToken, 2, false},
+		{"token rejected", 0, "t1.v2.expired-token", 0, true},
+		{"forbidden", http.StatusForbidden, testSenseToken, 0, true},
+		{"Sense down", http.StatusServiceUnavailable, testSenseToken, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			influx := setupTest(t)
+			server := newFakeSenseRealtime(t, test.status)
+			config.Set("sense.realtime.url", "ws://"+strings.TrimPrefix(server.URL, "http://"))
+			config.Set("sense.monitorID", "12345")
+			stateMutex.Lock()
+			state.Sense.AccessToken = test.token
+			stateMutex.Unlock()
+
+			if err := readSenseRealtime(); err == nil {
+				t.Fatal("feed ended without an error")
+			}
+
+			lines := influx.lines()
+			if len(lines) != test.points {
+				t.Errorf("points written:\n%s\nwant %d", strings.Join(lines, "\n"), test.points)
+			}
+			if test.points > 0 {
+				for i, line := range lines {
+					lines[i] = line[:strings.LastIndex(line, " ")]
+				}
+				assertLines(t, lines, []string{
+					`sense_device,deviceID=a1b2c3,deviceName=Fridge,senseMonitorID=12345 W=61.5`,
+					`sense_realtime,senseMonitorID=12345 GridW=-687.1,Hz=60.01,SolarW=2210.5,Voltage1=121.2,Voltage2=120.8,W=1523.4`,
+				})
+			}
+
+			stateMutex.Lock()
+			stored := state.Sense.AccessToken
+			stateMutex.Unlock()
+			if invalidated := stored == ""; invalidated != test.invalidated {
+				t.Errorf("token invalidated %v, want %v", invalidated, test.invalidated)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gookit/config/v2"
+)
+
+const defaultStateFilePath = "state.json"
+
+// collectorState is everything the collector learns at runtime and needs to
+// keep across restarts. It is stored in its own file so config.yaml is never
+// rewritten by the process.
+type collectorState struct {
+	Envoys map[string]*envoyState `json:"envoys,omitempty"`
+	Alerts map[string]activeAlert `json:"alerts,omitempty"`
+	Sense  senseState             `json:"sense"`
+}
+
+// senseState keeps the Sense access token, logging in on every start gets
+// the account rate limited
+type senseState struct {
+	AccessToken string `json:"accessToken,omitempty"`
+}
+
+// envoyState is the state of one Envoy, keyed by serial in collectorState
+type envoyState struct {
+	JWT JWTToken `json:"jwt"`
+	// CertificateFingerprint is the Envoy certificate pinned on first connect
+	CertificateFingerprint string `json:"certificateFingerprint,omitempty"`
+	// Firmware is the software version last seen in /info.xml
+	Firmware string `json:"firmware,omitempty"`
+	// Outage is the grid outage in progress, if any
+	Outage *outageState `json:"outage,omitempty"`
+	// PowerQualityEvents are the sags, swells and frequency excursions in
+	// progress, by type and phase
+	PowerQualityEvents map[string]pqEvent `json:"powerQualityEvents,omitempty"`
+	// LastEventID is the newest event log entry already written
+	LastEventID int64 `json:"lastEventID,omitempty"`
+	// Counters are the last good lifetime counters, raw and corrected, by
+	// production type or consumption measurement type
+	Counters map[string]storedCounter `json:"counters,omitempty"`
+	// Rollup holds the day, month and year in progress
+	Rollup *rollupState `json:"rollup,omitempty"`
+}
+
+// envoyStateFor returns the state of the Envoy with the given serial,
+// creating it if needed. It must be called with stateMutex held.
+func (s *collectorState) envoyStateFor(serial string) *envoyState {
+	if s.Envoys == nil {
+		s.Envoys = map[string]*envoyState{}
+	}
+	if s.Envoys[serial] == nil {
+		s.Envoys[serial] = &envoyState{}
+	}
+	return s.Envoys[serial]
+}
+
+var (
+	state      collectorState
+	stateMutex sync.Mutex
+)
+
+func stateFilePath() string {
+	return config.String("stateFile", defaultStateFilePath)
+}
+
+// loadState reads the state file, a missing file simply means a fresh start
+func loadState() error {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	body, err := os.ReadFile(stateFilePath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, &state)
+}
+
+// updateState applies fn to the state and persists the result
+func updateState(fn func(s *collectorState)) error {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	fn(&state)
+
+	return writeStateFile()
+}
+
+// writeStateFile must be called with stateMutex held. The file is written to a
+// temporary file first so a crash never leaves a truncated state behind.
+func writeStateFile() error {
+	body, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := stateFilePath()
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".state-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+	_ "time/tzdata" // the Docker image has no zoneinfo
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+var (
+	siteLocationOnce sync.Once
+	siteLocationZone *time.Location
+)
+
+// siteLocation is the timezone of the site, the timezone setting (an IANA
+// name such as Europe/Paris), the process timezone when unset. Day, month
+// and year boundaries are all computed in it.
+func siteLocation() *time.Location {
+	siteLocationOnce.Do(func() {
+		siteLocationZone = time.Local
+		name := config.String("timezone")
+		if name == "" {
+			return
+		}
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			splunkLogger.WithFields(log.Fields{"Error": "Unknown timezone, using the process timezone", "timezone": name}).Error(err)
+			return
+		}
+		siteLocationZone = location
+	})
+	return siteLocationZone
+}
+
+// localMidnight is the first instant of a day. Where DST starts at midnight
+// (e.g. America/Sao_Paulo until 2019) 00:00 doesn't exist and time.Date
+// lands on 23:00 the day before, the day then starts at 01:00.
+func localMidnight(year int, month time.Month, day int, location *time.Location) time.Time {
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, location)
+	want := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	for midnight.Day() != want.Day() {
+		midnight = midnight.Add(time.Hour).Truncate(time.Hour)
+	}
+	return midnight
+}
+
+// startOfDay is the start of the day t falls in at the site
+func startOfDay(t time.Time) time.Time {
+	t = t.In(siteLocation())
+	return localMidnight(t.Year(), t.Month(), t.Day(), t.Location())
+}
+
+// startOfPeriod is the start of the DAY, WEEK (starting Sunday, like Sense),
+// MONTH or YEAR t falls in at the site
+func startOfPeriod(t time.Time, scale string) time.Time {
+	day := startOfDay(t)
+	switch scale {
+	case "WEEK":
+		return localMidnight(day.Year(), day.Month(), day.Day()-int(day.Weekday()), day.Location())
+	case "MONTH":
+		return localMidnight(day.Year(), day.Month(), 1, day.Location())
+	case "YEAR":
+		return localMidnight(day.Year(), time.January, 1, day.Location())
+	}
+	return day
+}
+
+// endOfPeriod is the start of the period after the one starting at start
+func endOfPeriod(start time.Time, scale string) time.Time {
+	start = start.In(siteLocation())
+	year, month, day := start.Date()
+	switch scale {
+	case "WEEK":
+		return localMidnight(year, month, day+7, start.Location())
+	case "MONTH":
+		return localMidnight(year, month+1, 1, start.Location())
+	case "YEAR":
+		return localMidnight(year+1, time.January, 1, start.Location())
+	}
+	return localMidnight(year, month, day+1, start.Location())
+}
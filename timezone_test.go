@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gookit/config/v2"
+)
+
+// setSiteLocation makes siteLocation load the timezone again
+func setSiteLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	config.Set("timezone", name)
+	siteLocationOnce = sync.Once{}
+	t.Cleanup(func() { siteLocationOnce = sync.Once{} })
+
+	location := siteLocation()
+	if location.String() != name {
+		t.Fatalf("site location %s, want %s", location, name)
+	}
+	return location
+}
+
+func mustParse(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestStartOfPeriod(t *testing.T) {
+	tests := []struct {
+		name     string
+		timezone string
+		time     string
+		scale    string
+		expected string
+	}{
+		// 2024-03-10 02:00 EST jumps to 03:00 EDT, the day is 23 hours long
+		{"spring forward, before", "America/New_York", "2024-03-10T01:59:00-05:00", "DAY", "2024-03-10T00:00:00-05:00"},
+		{"spring forward, after", "America/New_York", "2024-03-10T03:00:00-04:00", "DAY", "2024-03-10T00:00:00-05:00"},
+		{"spring forward, next day", "America/New_York", "2024-03-11T00:30:00-04:00", "DAY", "2024-03-11T00:00:00-04:00"},
+		{"spring forward, week", "America/New_York", "2024-03-13T12:00:00-04:00", "WEEK", "2024-03-10T00:00:00-05:00"},
+		{"spring forward, month", "America/New_York", "2024-03-31T23:59:00-04:00", "MONTH", "2024-03-01T00:00:00-05:00"},
+		// 2024-11-03 02:00 EDT goes back to 01:00 EST, 01:30 happens twice
+		{"fall back, first 01:30", "America/New_York", "2024-11-03T01:30:00-04:00", "DAY", "2024-11-03T00:00:00-04:00"},
+		{"fall back, second 01:30", "America/New_York", "2024-11-03T01:30:00-05:00", "DAY", "2024-11-03T00:00:00-04:00"},
+		{"fall back, last minute", "America/New_York", "2024-11-03T23:59:00-05:00", "DAY", "2024-11-03T00:00:00-04:00"},
+		{"fall back, year", "America/New_York", "2024-11-03T01:30:00-05:00", "YEAR", "2024-01-01T00:00:00-05:00"},
+		// 2018-11-04 00:00 -03 jumped to 01:00 -02, the day starts at 01:00
+		{"midnight DST start, day", "America/Sao_Paulo", "2018-11-04T12:00:00-02:00", "DAY", "2018-11-04T01:00:00-02:00"},
+		{"midnight DST start, first instant", "America/Sao_Paulo", "2018-11-04T01:00:00-02:00", "DAY", "2018-11-04T01:00:00-02:00"},
+		{"midnight DST start, day before", "America/Sao_Paulo", "2018-11-03T23:59:00-03:00", "DAY", "2018-11-03T00:00:00-03:00"},
+		{"midnight DST start, week", "America/Sao_Paulo", "2018-11-07T08:00:00-02:00", "WEEK", "2018-11-04T01:00:00-02:00"},
+		{"midnight DST start, month", "America/Sao_Paulo", "2018-11-04T12:00:00-02:00", "MONTH", "2018-11-01T00:00:00-03:00"},
+		// 2019-02-17 00:00 -02 went back to 2019-02-16 23:00 -03
+		{"midnight DST end, second 23:30", "America/Sao_Paulo", "2019-02-16T23:30:00-03:00", "DAY", "2019-02-16T00:00:00-02:00"},
+		{"midnight DST end, next day", "America/Sao_Paulo", "2019-02-17T00:00:00-03:00", "DAY", "2019-02-17T00:00:00-03:00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setSiteLocation(t, test.timezone)
+			got := startOfPeriod(mustParse(t, test.time), test.scale)
+			if expected := mustParse(t, test.expected); !got.Equal(expected) {
+				t.Errorf("startOfPeriod(%s, %s) = %s, want %s", test.time, test.scale, got, expected)
+			}
+			if got.Location().String() != test.timezone {
+				t.Errorf("startOfPeriod returned a time in %s", got.Location())
+			}
+		})
+	}
+}
+
+func TestLocalMidnightDayLength(t *testing.T) {
+	tests := []struct {
+		timezone string
+		day      string
+		hours    float64
+	}{
+		{"America/New_York", "2024-03-10", 23},
+		{"America/New_York", "2024-11-03", 25},
+		{"America/New_York", "2024-07-04", 24},
+		{"America/Sao_Paulo", "2018-11-04", 23},
+		{"America/Sao_Paulo", "2018-11-03", 24},
+		{"America/Sao_Paulo", "2019-02-16", 25},
+	}
+	for _, test := range tests {
+		location := setSiteLocation(t, test.timezone)
+		day, err := time.ParseInLocation("2006-01-02", test.day, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := localMidnight(day.Year(), day.Month(), day.Day(), location)
+		end := localMidnight(day.Year(), day.Month(), day.Day()+1, location)
+		if hours := end.Sub(start).Hours(); hours != test.hours {
+			t.Errorf("%s in %s lasts %v hours, want %v", test.day, test.timezone, hours, test.hours)
+		}
+		if !startOfDay(end.Add(-time.Nanosecond)).Equal(start) || !startOfDay(start).Equal(start) {
+			t.Errorf("startOfDay doesn't agree with localMidnight on %s in %s", test.day, test.timezone)
+		}
+	}
+}
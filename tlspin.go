@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Envoys serve a self-signed certificate that no hostname verification can
+// pass, so instead of trusting anything on the LAN the certificate is pinned:
+//   - tlsFingerprint: the SHA-256 fingerprint of the certificate, in hex
+//   - caFile: a PEM bundle the certificate must chain to, the hostname is not checked
+//   - otherwise the fingerprint seen on first connect is stored in state and
+//     required from then on (trust on first use)
+//
+// insecureSkipVerify: true turns all of it off.
+
+func certificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint accepts the AA:BB:... form browsers and openssl print
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+}
+
+// transport returns the HTTP transport every call to this Envoy goes through
+func (e *envoyClient) transport() *http.Transport {
+	if e.settingBool("insecureSkipVerify") {
+		e.logger.Warnln("TLS verification of the Envoy is disabled, anything on the LAN can impersonate it")
+		return &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	var roots *x509.CertPool
+	if caFile := e.setting("caFile"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			e.logger.WithFields(log.Fields{"Error": "Error reading Envoy CA file", "caFile": caFile}).Error(err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			e.logger.WithFields(log.Fields{"caFile": caFile}).Errorln("No certificate found in Envoy CA file, every connection will be refused")
+		}
+	}
+
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{
+			// Verification is done below, without the hostname check
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 {
+					return errors.New("the Envoy sent no certificate")
+				}
+				if roots != nil {
+					return verifyChain(rawCerts, roots)
+				}
+				return e.verifyFingerprint(certificateFingerprint(rawCerts[0]))
+			},
+		},
+	}
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	intermediates := x509.NewCertPool()
+	var leaf *x509.Certificate
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			leaf = cert
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	if err != nil {
+		return fmt.Errorf("the Envoy certificate doesn't chain to caFile: %w", err)
+	}
+	return nil
+}
+
+// verifyFingerprint compares with the fingerprint configured for this Envoy,
+// or with the one stored in state, storing it when this is the first
+// connection. A tlsFingerprint under enphase only pins the Envoy configured
+// there, not those of enphase.envoys: it can't match them all.
+func (e *envoyClient) verifyFingerprint(fingerprint string) error {
+	if pinned := e.ownSetting("tlsFingerprint"); pinned != "" {
+		if normalizeFingerprint(pinned) != fingerprint {
+			return fmt.Errorf("the Envoy certificate fingerprint %s doesn't match tlsFingerprint %s, refusing to connect to %s", fingerprint, normalizeFingerprint(pinned), e.baseURL)
+		}
+		return nil
+	}
+
+	stateMutex.Lock()
+	stored := state.envoyStateFor(e.serial).CertificateFingerprint
+	stateMutex.Unlock()
+
+	if stored == "" {
+		e.logger.WithFields(log.Fields{"fingerprint": fingerprint, "host": e.baseURL}).Warnln("Pinning the Envoy certificate seen on first connect")
+		return updateState(func(s *collectorState) {
+			s.envoyStateFor(e.serial).CertificateFingerprint = fingerprint
+		})
+	}
+
+	if stored != fingerprint {
+		return fmt.Errorf("the Envoy certificate changed: fingerprint %s, pinned %s, refusing to connect to %s. If the Envoy was replaced or its certificate renewed, remove certificateFingerprint for %s from %s", fingerprint, stored, e.baseURL, e.serial, stateFilePath())
+	}
+	return nil
+}
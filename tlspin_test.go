@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gookit/config/v2"
+)
+
+func TestFingerprintPinnedPerEnvoy(t *testing.T) {
+	otherEnvoy := strings.Repeat("ab", 32)
+	tests := []struct {
+		name      string
+		entry     map[string]interface{}
+		connected bool
+	}{
+		{"global pin ignored", map[string]interface{}{}, true},
+		{"own pin", map[string]interface{}{"tlsFingerprint": otherEnvoy}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupTest(t)
+			envoyURL := newFakeEnvoy(t, nil).URL
+			newTestEnvoy(t, "https://10.0.0.190", "https://enlighten.invalid")
+			config.Set("enphase.tlsFingerprint", otherEnvoy)
+			test.entry["EnphaseEnvoySerial"] = testEnvoySerial
+			test.entry["EnvoyHost"] = envoyURL
+			config.Set("enphase.envoys", []interface{}{test.entry})
+
+			envoy := newEnvoyClient("enphase.envoys.0")
+			_, err := envoy.loadInfo()
+			if connected := err == nil; connected != test.connected {
+				t.Fatalf("connected %v: %v", connected, err)
+			}
+
+			stateMutex.Lock()
+			pinned := state.envoyStateFor(testEnvoySerial).CertificateFingerprint
+			stateMutex.Unlock()
+			if test.connected && pinned == "" {
+				t.Error("certificate not pinned on first connect")
+			}
+		})
+	}
+}
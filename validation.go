@@ -0,0 +1,247 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gookit/config/v2"
+)
+
+// counterCheck follows one energy counter of one Envoy between polls. A
+// reading that goes backwards or jumps more than the system could have
+// produced since the last good one is a discontinuity: it is rejected, and
+// only taken as the new baseline once validation.confirmSamples readings
+// in a row agree with it, so a single glitch can't rebase the counter.
+type counterCheck struct {
+	last     float64 // highest good reading, the counter is monotonic
+	lastTime time.Time
+	// offset is added to the raw lifetime counter to keep it monotonic over
+	// resets, it is kept in state
+	offset float64
+
+	pendingFirst float64
+	pendingLast  float64
+	pendingTime  time.Time
+	pendingCount int
+}
+
+// storedCounter is a lifetime counter as kept in state, so the first reading
+// after a restart is checked against the last one before it and a reset
+// while the collector was stopped still doesn't make the corrected counter
+// go back
+type storedCounter struct {
+	Raw       float64   `json:"raw"`
+	Corrected float64   `json:"corrected"`
+	Time      time.Time `json:"time"`
+}
+
+// restoreCounter carries on from the counter kept in state
+func restoreCounter(stored storedCounter) *counterCheck {
+	return &counterCheck{last: stored.Raw, lastTime: stored.Time, offset: stored.Corrected - stored.Raw}
+}
+
+func (c *counterCheck) stored() storedCounter {
+	return storedCounter{Raw: c.last, Corrected: c.last + c.offset, Time: c.lastTime}
+}
+
+// validation is what the validation stage says about one production or
+// consumption entry. invalidFields are the counters that failed, the other
+// fields of the entry are fine.
+type validation struct {
+	valid               bool
+	reason              string
+	invalidFields       []string
+	whLifetimeCorrected float64
+	hasCorrected        bool
+}
+
+func validationKey(measurement string, entryType string) string {
+	return measurement + "/" + entryType
+}
+
+// plausible tells whether a counter can go from one reading to the other
+// in the time between them, at capacity watts at most. Readings may go back
+// a little, production counters do at night. Without a capacity only resets
+// are caught, the counter falling back more than halfway.
+func plausible(from float64, fromTime time.Time, to float64, toTime time.Time, capacity float64) bool {
+	if capacity == 0 {
+		return to >= from/2
+	}
+	slack := capacity / 60
+	delta := to - from
+	if delta < -slack {
+		return false
+	}
+	return delta <= capacity*math.Max(toTime.Sub(fromTime).Hours(), 0)+slack
+}
+
+// check feeds one reading to the counter and tells whether it is good.
+// Daily counters start over from 0 at local midnight.
+func (c *counterCheck) check(value float64, t time.Time, capacity float64, daily bool) (bool, string) {
+	if c.lastTime.IsZero() {
+		c.last, c.lastTime = value, t
+		return true, ""
+	}
+	if daily && !startOfDay(t).Equal(startOfDay(c.lastTime)) {
+		c.last, c.lastTime = 0, startOfDay(t)
+	}
+
+	if plausible(c.last, c.lastTime, value, t, capacity) {
+		if value > c.last {
+			c.last = value
+		}
+		c.lastTime = t
+		c.pendingCount = 0
+		return true, ""
+	}
+
+	reason := "spike"
+	if value < c.last {
+		reason = "reset"
+	}
+
+	if c.pendingCount > 0 && plausible(c.pendingLast, c.pendingTime, value, t, capacity) {
+		c.pendingCount++
+		c.pendingLast, c.pendingTime = value, t
+	} else {
+		c.pendingFirst, c.pendingLast, c.pendingTime, c.pendingCount = value, value, t, 1
+	}
+	if c.pendingCount < config.Int("validation.confirmSamples", 3) {
+		return false, reason
+	}
+
+	// The new level held, carry on from there without counting the jump
+	c.offset += c.last - c.pendingFirst
+	c.last, c.lastTime = value, t
+	c.pendingCount = 0
+	return true, "rebased"
+}
+
+// capacities returns the most the system can produce and the site consume,
+// in watts, with validation.marginPercent on top. The nameplate is
+// nameplateWatts or, when unset, validation.inverterWatts per microinverter
+// seen active; 0 while it isn't known, jumps can't be checked then.
+func (envoy *envoyClient) capacities(enphaseData enphaseMetrics) (production float64, consumption float64) {
+	for _, data := range enphaseData.Production {
+		if data.Type == "inverters" && data.ActiveCount > envoy.maxActiveInverters {
+			envoy.maxActiveInverters = data.ActiveCount
+		}
+	}
+	production = float64(envoy.settingInt("nameplateWatts"))
+	if production == 0 {
+		production = float64(envoy.maxActiveInverters) * config.Float("validation.inverterWatts", 400)
+	}
+	consumption = config.Float("validation.maxConsumptionWatts", 48000)
+
+	margin := 1 + config.Float("validation.marginPercent", 50)/100
+	return production * margin, consumption * margin
+}
+
+// validateProductionData checks the lifetime and today counters of every
+// production and total consumption entry against the previous polls. Net
+// consumption is left alone, its counters go down while exporting. The
+// lifetime counters are saved to state once per poll.
+func validateProductionData(envoy *envoyClient, enphaseData enphaseMetrics, eventTime time.Time) map[string]validation {
+	validations := map[string]validation{}
+	if !config.Bool("validation.enabled", true) {
+		return validations
+	}
+
+	productionCapacity, consumptionCapacity := envoy.capacities(enphaseData)
+	if envoy.counters == nil {
+		envoy.counters = map[string]*counterCheck{}
+	}
+	stored := map[string]storedCounter{}
+
+	validate := func(key string, whLifetime float64, whToday float64, capacity float64) {
+		lifetime := envoy.counters[key+"/whLifetime"]
+		if lifetime == nil {
+			lifetime = &counterCheck{}
+			// Replays start from an empty state and must leave the real one alone
+			if *replayDir == "" {
+				stateMutex.Lock()
+				lifetime = restoreCounter(state.envoyStateFor(envoy.serial).Counters[key])
+				stateMutex.Unlock()
+			}
+			envoy.counters[key+"/whLifetime"] = lifetime
+		}
+		today := envoy.counters[key+"/WhToday"]
+		if today == nil {
+			today = &counterCheck{}
+			envoy.counters[key+"/WhToday"] = today
+		}
+
+		lifetimeValid, lifetimeReason := lifetime.check(whLifetime, eventTime, capacity, false)
+		todayValid, todayReason := today.check(whToday, eventTime, capacity, true)
+
+		result := validation{valid: lifetimeValid && todayValid, reason: lifetimeReason}
+		if result.reason == "" {
+			result.reason = todayReason
+		}
+		if lifetimeValid {
+			result.whLifetimeCorrected, result.hasCorrected = lifetime.last+lifetime.offset, true
+			stored[key] = lifetime.stored()
+		} else {
+			result.invalidFields = append(result.invalidFields, "whLifetime")
+		}
+		if !todayValid {
+			result.invalidFields = append(result.invalidFields, "WhToday")
+		}
+		validations[key] = result
+
+		if result.reason != "" {
+			envoy.logger.WithFields(log.Fields{"event": "counter_validation", "entry": key, "reason": result.reason, "whLifetime": whLifetime, "WhToday": whToday, "valid": result.valid}).Warnln("Suspicious Enphase energy counter")
+		}
+	}
+
+	for _, data := range enphaseData.Production {
+		validate(validationKey("production", data.Type), data.WhLifetime, data.WhToday, productionCapacity)
+	}
+	for _, data := range enphaseData.Consumption {
+		if data.MeasurementType == "total-consumption" {
+			validate(validationKey("consumption", data.MeasurementType), data.WhLifetime, data.WhToday, consumptionCapacity)
+		}
+	}
+
+	if len(stored) > 0 && *replayDir == "" {
+		writeStateError := updateState(func(s *collectorState) {
+			envoyState := s.envoyStateFor(envoy.serial)
+			if envoyState.Counters == nil {
+				envoyState.Counters = map[string]storedCounter{}
+			}
+			for key, counter := range stored {
+				envoyState.Counters[key] = counter
+			}
+		})
+		if writeStateError != nil {
+			envoy.logger.WithFields(log.Fields{"Error": "Error saving energy counters to state"}).Error(writeStateError)
+		}
+	}
+	return validations
+}
+
+// applyValidation adds what the validation stage found to the fields of a
+// point. Bad counters are dropped from it, or kept with suspect set when
+// validation.action is flag; the other fields are written either way.
+func applyValidation(validations map[string]validation, key string, fields map[string]interface{}) {
+	result, ok := validations[key]
+	if !ok {
+		return
+	}
+	if result.hasCorrected {
+		fields["whLifetimeCorrected"] = result.whLifetimeCorrected
+	}
+	if result.valid {
+		return
+	}
+	if config.String("validation.action", "drop") != "flag" {
+		for _, name := range result.invalidFields {
+			delete(fields, name)
+		}
+		return
+	}
+	fields["suspect"] = true
+	fields["suspectReason"] = result.reason
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gookit/config/v2"
+)
+
+func productionReading(whLifetime float64, whToday float64) enphaseMetrics {
+	return enphaseMetrics{Production: []Production{{Type: "eim", ActiveCount: 1, WhLifetime: whLifetime, WhToday: whToday}}}
+}
+
+func TestCounterResetWhileStopped(t *testing.T) {
+	setupTest(t)
+	config.Set("enphase.nameplateWatts", 5000)
+	key := validationKey("production", "eim")
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+
+	envoy := newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+	for i, whLifetime := range []float64{100000, 100500} {
+		validations := validateProductionData(envoy, productionReading(whLifetime, 1000+500*float64(i)), start.Add(time.Duration(i)*15*time.Minute))
+		if result := validations[key]; !result.valid || result.whLifetimeCorrected != whLifetime {
+			t.Fatalf("reading %v before the restart: %+v", whLifetime, result)
+		}
+	}
+
+	// The collector restarts, the Envoy was reset in the meantime
+	envoy = newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+	restart := start.Add(2 * time.Hour)
+	expected := []struct {
+		whLifetime float64
+		valid      bool
+		reason     string
+		corrected  float64
+	}{
+		{200, false, "reset", 0},
+		{300, false, "reset", 0},
+		{400, true, "rebased", 100700},
+		{900, true, "", 101200},
+	}
+	for i, reading := range expected {
+		validations := validateProductionData(envoy, productionReading(reading.whLifetime, 100*float64(i+1)), restart.Add(time.Duration(i)*15*time.Minute))
+		result := validations[key]
+		if result.valid != reading.valid || result.reason != reading.reason {
+			t.Errorf("reading %v after the restart: valid %v %q, want %v %q", reading.whLifetime, result.valid, result.reason, reading.valid, reading.reason)
+		}
+		if reading.valid && result.whLifetimeCorrected != reading.corrected {
+			t.Errorf("reading %v after the restart corrected to %v, want %v", reading.whLifetime, result.whLifetimeCorrected, reading.corrected)
+		}
+	}
+
+	stateMutex.Lock()
+	stored := state.envoyStateFor(testEnvoySerial).Counters[key]
+	stateMutex.Unlock()
+	if stored.Raw != 900 || stored.Corrected != 101200 {
+		t.Errorf("state keeps %+v", stored)
+	}
+}
+
+func TestCounterCarriesOnAfterRestart(t *testing.T) {
+	setupTest(t)
+	config.Set("enphase.nameplateWatts", 5000)
+	key := validationKey("production", "eim")
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+
+	stateMutex.Lock()
+	state.envoyStateFor(testEnvoySerial).Counters = map[string]storedCounter{key: {Raw: 1000, Corrected: 51000, Time: start}}
+	stateMutex.Unlock()
+
+	envoy := newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+	tests := []struct {
+		whLifetime float64
+		at         time.Duration
+		valid      bool
+		corrected  float64
+	}{
+		// More than 5000W with the margin could make in 15 minutes
+		{10000, 15 * time.Minute, false, 0},
+		{2000, 30 * time.Minute, true, 52000},
+	}
+	for _, test := range tests {
+		result := validateProductionData(envoy, productionReading(test.whLifetime, 0), start.Add(test.at))[key]
+		if result.valid != test.valid || (test.valid && result.whLifetimeCorrected != test.corrected) {
+			t.Errorf("reading %v: %+v", test.whLifetime, result)
+		}
+	}
+}
+
+func TestBadCounterKeepsOtherFields(t *testing.T) {
+	setupTest(t)
+	config.Set("enphase.nameplateWatts", 5000)
+	key := validationKey("production", "eim")
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	envoy := newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+
+	validateProductionData(envoy, productionReading(100000, 1000), start)
+	// whLifetime jumps by 1MWh in 15 minutes, WhToday is fine
+	validations := validateProductionData(envoy, productionReading(1100000, 1500), start.Add(15*time.Minute))
+	fields := map[string]interface{}{"whLifetime": 1100000.0, "WhToday": 1500.0, "WNow": 2000.0, "activeInverterCounts": 12}
+	applyValidation(validations, key, fields)
+
+	if _, ok := fields["whLifetime"]; ok {
+		t.Error("implausible whLifetime written")
+	}
+	for _, name := range []string{"WhToday", "WNow", "activeInverterCounts"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("%s dropped with the bad whLifetime", name)
+		}
+	}
+}
+
+func TestCounterResetWithoutNameplate(t *testing.T) {
+	setupTest(t)
+	key := validationKey("production", "eim")
+	start := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	envoy := newTestEnvoy(t, "https://envoy.invalid", "https://enlighten.invalid")
+
+	expected := []struct {
+		whLifetime float64
+		valid      bool
+		corrected  float64
+	}{
+		{100000, true, 100000},
+		{900000, true, 900000},
+		{200, false, 0},
+		{300, false, 0},
+		{400, true, 900200},
+	}
+	for i, reading := range expected {
+		result := validateProductionData(envoy, productionReading(reading.whLifetime, 0), start.Add(time.Duration(i)*15*time.Minute))[key]
+		if result.valid != reading.valid || (reading.valid && result.whLifetimeCorrected != reading.corrected) {
+			t.Errorf("reading %v without a nameplate: %+v", reading.whLifetime, result)
+		}
+	}
+}